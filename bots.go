@@ -0,0 +1,700 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// botRule - single bot detection rule, all matching is case insensitive
+// Usernames are exact identity usernames, UsernamePatterns and Emails are globs (* and ? wildcards),
+// UsernameRegexps are regular expressions, ProfileNames are exact profile names
+// Sources are globs limiting identity sources checked by username and email rules, empty means all sources
+// Disabled rules are skipped
+type botRule struct {
+	Name             string   `yaml:"name"`
+	Sources          []string `yaml:"sources"`
+	Usernames        []string `yaml:"usernames"`
+	UsernamePatterns []string `yaml:"username_patterns"`
+	UsernameRegexps  []string `yaml:"username_regexps"`
+	Emails           []string `yaml:"emails"`
+	ProfileNames     []string `yaml:"profile_names"`
+	Disabled         bool     `yaml:"disabled"`
+}
+
+// botAllowlist - identities and profiles that are never marked as bots, even when they match some rules
+// Usernames, Emails and ProfileNames are exact (case insensitive) values
+type botAllowlist struct {
+	UUIDs        []string `yaml:"uuids"`
+	Usernames    []string `yaml:"usernames"`
+	Emails       []string `yaml:"emails"`
+	ProfileNames []string `yaml:"profile_names"`
+}
+
+// botSignal - heuristic bot signal, Field is one of: username, name, email, affiliation (devstats)
+// Pattern is a case insensitive regular expression, Weight is signal's probability (0-1) of being a bot
+type botSignal struct {
+	Name    string  `yaml:"name"`
+	Field   string  `yaml:"field"`
+	Pattern string  `yaml:"pattern"`
+	Weight  float64 `yaml:"weight"`
+}
+
+// botHeuristics - heuristic bot scoring configuration
+// UUIDs with score >= Threshold are marked as bots, scores >= ReviewThreshold are written to review CSV
+type botHeuristics struct {
+	Threshold       float64      `yaml:"threshold"`
+	ReviewThreshold float64      `yaml:"review_threshold"`
+	Signals         []*botSignal `yaml:"signals"`
+}
+
+// allBotRules - bot rules YAML
+type allBotRules struct {
+	Rules      []*botRule     `yaml:"rules"`
+	Allow      *botAllowlist  `yaml:"allow"`
+	Heuristics *botHeuristics `yaml:"heuristics"`
+}
+
+// compiledSignal - heuristic bot signal ready to be matched
+type compiledSignal struct {
+	name   string
+	field  string
+	re     *regexp.Regexp
+	weight float64
+}
+
+// botScorer - combines heuristic signals into a bot score
+type botScorer struct {
+	signals   []*compiledSignal
+	threshold float64
+	review    float64
+}
+
+// botValues - all known values of a given UUID, field -> values
+type botValues map[string]map[string]struct{}
+
+// compiledAllowlist - bot allowlist with lower case values
+type compiledAllowlist struct {
+	uuids        map[string]struct{}
+	usernames    map[string]struct{}
+	emails       map[string]struct{}
+	profileNames map[string]struct{}
+}
+
+// botsState - UUIDs marked as bots by json2hat, only these can be cleared when they no longer match
+type botsState struct {
+	UUIDs []string `json:"uuids"`
+}
+
+// compiledBotRule - bot rule ready to be matched
+type compiledBotRule struct {
+	name         string
+	sources      []*regexp.Regexp
+	usernames    map[string]struct{}
+	usernameRes  []*regexp.Regexp
+	emails       []*regexp.Regexp
+	profileNames map[string]struct{}
+}
+
+// botMatch - why given UUID was detected as a bot
+type botMatch struct {
+	rule  string
+	field string
+	value string
+}
+
+// globToRegexp - compiles case insensitive glob pattern, only * and ? are wildcards
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	reStr := regexp.QuoteMeta(strings.ToLower(glob))
+	reStr = strings.Replace(reStr, regexp.QuoteMeta("*"), ".*", -1)
+	reStr = strings.Replace(reStr, regexp.QuoteMeta("?"), ".", -1)
+	return regexp.Compile("^" + reStr + "$")
+}
+
+// compile - compiles rule patterns, rule name is used in error messages
+func (r *botRule) compile() (c *compiledBotRule, err error) {
+	c = &compiledBotRule{
+		name:         r.Name,
+		usernames:    make(map[string]struct{}),
+		profileNames: make(map[string]struct{}),
+	}
+	globs := func(patterns []string) (res []*regexp.Regexp, err error) {
+		for _, pattern := range patterns {
+			var re *regexp.Regexp
+			re, err = globToRegexp(pattern)
+			if err != nil {
+				err = fmt.Errorf("bot rule %s: invalid pattern '%s': %v", r.Name, pattern, err)
+				return
+			}
+			res = append(res, re)
+		}
+		return
+	}
+	c.sources, err = globs(r.Sources)
+	if err != nil {
+		return
+	}
+	c.usernameRes, err = globs(r.UsernamePatterns)
+	if err != nil {
+		return
+	}
+	c.emails, err = globs(r.Emails)
+	if err != nil {
+		return
+	}
+	for _, reStr := range r.UsernameRegexps {
+		var re *regexp.Regexp
+		re, err = regexp.Compile("(?i)" + reStr)
+		if err != nil {
+			err = fmt.Errorf("bot rule %s: invalid regexp '%s': %v", r.Name, reStr, err)
+			return
+		}
+		c.usernameRes = append(c.usernameRes, re)
+	}
+	for _, username := range r.Usernames {
+		c.usernames[strings.ToLower(username)] = struct{}{}
+	}
+	for _, name := range r.ProfileNames {
+		c.profileNames[strings.ToLower(name)] = struct{}{}
+	}
+	return
+}
+
+// matchSource - checks if identity source is covered by the rule
+func (c *compiledBotRule) matchSource(source string) bool {
+	if len(c.sources) == 0 {
+		return true
+	}
+	source = strings.ToLower(source)
+	for _, re := range c.sources {
+		if re.MatchString(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIdentity - returns matching field and value or empty field when identity doesn't match the rule
+func (c *compiledBotRule) matchIdentity(source string, username, email *string) (string, string) {
+	if !c.matchSource(source) {
+		return "", ""
+	}
+	if username != nil && *username != "" {
+		lUsername := strings.ToLower(*username)
+		_, ok := c.usernames[lUsername]
+		if ok {
+			return "username", *username
+		}
+		for _, re := range c.usernameRes {
+			if re.MatchString(lUsername) {
+				return "username", *username
+			}
+		}
+	}
+	if email != nil && *email != "" {
+		lEmail := strings.ToLower(*email)
+		for _, re := range c.emails {
+			if re.MatchString(lEmail) {
+				return "email", *email
+			}
+		}
+	}
+	return "", ""
+}
+
+// compile - lower cases allowlist values
+func (a *botAllowlist) compile() *compiledAllowlist {
+	c := &compiledAllowlist{
+		uuids:        make(map[string]struct{}),
+		usernames:    make(map[string]struct{}),
+		emails:       make(map[string]struct{}),
+		profileNames: make(map[string]struct{}),
+	}
+	if a == nil {
+		return c
+	}
+	for _, uuid := range a.UUIDs {
+		c.uuids[uuid] = struct{}{}
+	}
+	for _, username := range a.Usernames {
+		c.usernames[strings.ToLower(username)] = struct{}{}
+	}
+	for _, email := range a.Emails {
+		c.emails[strings.ToLower(email)] = struct{}{}
+	}
+	for _, name := range a.ProfileNames {
+		c.profileNames[strings.ToLower(name)] = struct{}{}
+	}
+	return c
+}
+
+// contains - checks if value (compared lower case) is in a given allowlist set
+func (c *compiledAllowlist) contains(set map[string]struct{}, value *string) bool {
+	if value == nil || *value == "" {
+		return false
+	}
+	_, ok := set[strings.ToLower(*value)]
+	return ok
+}
+
+// Heuristic signal fields
+const (
+	cSignalUsername    = "username"
+	cSignalName        = "name"
+	cSignalEmail       = "email"
+	cSignalAffiliation = "affiliation"
+)
+
+// add - adds non-empty value of a given field
+func (v botValues) add(field string, value *string) {
+	if value == nil || *value == "" {
+		return
+	}
+	_, ok := v[field]
+	if !ok {
+		v[field] = make(map[string]struct{})
+	}
+	v[field][*value] = struct{}{}
+}
+
+// compile - compiles heuristics, BOT_SCORE_THRESHOLD and BOT_REVIEW_THRESHOLD override YAML thresholds
+// Thresholds default to 0.8 and 0.4
+func (h *botHeuristics) compile() (scorer *botScorer, err error) {
+	scorer = &botScorer{threshold: 0.8, review: 0.4}
+	if h != nil && h.Threshold > 0 {
+		scorer.threshold = h.Threshold
+	}
+	if h != nil && h.ReviewThreshold > 0 {
+		scorer.review = h.ReviewThreshold
+	}
+	for env, threshold := range map[string]*float64{"BOT_SCORE_THRESHOLD": &scorer.threshold, "BOT_REVIEW_THRESHOLD": &scorer.review} {
+		sThreshold := os.Getenv(env)
+		if sThreshold == "" {
+			continue
+		}
+		*threshold, err = strconv.ParseFloat(sThreshold, 64)
+		if err != nil {
+			return
+		}
+	}
+	if h == nil {
+		return
+	}
+	for _, signal := range h.Signals {
+		switch signal.Field {
+		case cSignalUsername, cSignalName, cSignalEmail, cSignalAffiliation:
+		default:
+			err = fmt.Errorf("bot signal %s: unknown field '%s', allowed: username, name, email, affiliation", signal.Name, signal.Field)
+			return
+		}
+		if signal.Weight <= 0 || signal.Weight > 1 {
+			err = fmt.Errorf("bot signal %s: weight %g must be in (0, 1] range", signal.Name, signal.Weight)
+			return
+		}
+		var re *regexp.Regexp
+		re, err = regexp.Compile("(?i)" + signal.Pattern)
+		if err != nil {
+			err = fmt.Errorf("bot signal %s: invalid pattern '%s': %v", signal.Name, signal.Pattern, err)
+			return
+		}
+		scorer.signals = append(scorer.signals, &compiledSignal{name: signal.Name, field: signal.Field, re: re, weight: signal.Weight})
+	}
+	return
+}
+
+// score - combines all firing signals as independent evidence: 1 - (1 - w1) * (1 - w2) * ...
+// Each signal counts once, returns score and firing signals with matching values
+func (s *botScorer) score(values botValues) (float64, []string) {
+	notBot := 1.0
+	evidence := []string{}
+	for _, signal := range s.signals {
+		matched := []string{}
+		for value := range values[signal.field] {
+			if signal.re.MatchString(value) {
+				matched = append(matched, value)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		sort.Strings(matched)
+		notBot *= 1.0 - signal.weight
+		evidence = append(evidence, signal.name+"("+strings.Join(matched, ",")+")")
+	}
+	return 1.0 - notBot, evidence
+}
+
+// botConfig - compiled bot rules, allowlist and heuristic scorer (nil when heuristics are not used)
+type botConfig struct {
+	rules  []*compiledBotRule
+	allow  *compiledAllowlist
+	scorer *botScorer
+}
+
+// getBotRules - reads bot rules, allowlist and heuristics from BOT_RULES_YAML file, defaults to bots.yaml
+// Heuristic scorer is only set when BOT_HEURISTICS is set
+// Called before any DB writes, so invalid rules file never fails the import after data was written
+func getBotRules() *botConfig {
+	if os.Getenv("BOTS_CLEAR") != "" && os.Getenv("BOTS_STATE") == "" {
+		fatalf("BOTS_CLEAR requires BOTS_STATE, only bots marked by json2hat can be cleared")
+	}
+	path := os.Getenv("BOT_RULES_YAML")
+	if path == "" {
+		path = "bots.yaml"
+	}
+	data, err := ioutil.ReadFile(path)
+	fatalOnError(err)
+	var (
+		all    allBotRules
+		rules  []*compiledBotRule
+		scorer *botScorer
+	)
+	parseYAMLSource(data, path, &all)
+	names := make(stringSet)
+	for i, rule := range all.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		_, ok := names[rule.Name]
+		if ok {
+			fatalf("bot rule %s is defined more than once in %s", rule.Name, path)
+		}
+		names[rule.Name] = struct{}{}
+		if rule.Disabled {
+			continue
+		}
+		compiled, err := rule.compile()
+		fatalOnError(err)
+		rules = append(rules, compiled)
+	}
+	allow := all.Allow.compile()
+	fmt.Printf("Read %d bot rules (%d enabled) from %s\n", len(all.Rules), len(rules), path)
+	if os.Getenv("BOT_HEURISTICS") != "" {
+		scorer, err = all.Heuristics.compile()
+		fatalOnError(err)
+		if len(scorer.signals) == 0 {
+			fatalf("BOT_HEURISTICS is set but there are no heuristic signals in %s", path)
+		}
+		fmt.Printf("Using %d bot heuristic signals, threshold %g, review threshold %g\n", len(scorer.signals), scorer.threshold, scorer.review)
+	}
+	return &botConfig{rules: rules, allow: allow, scorer: scorer}
+}
+
+// detectBots - applies bot rules to all identities and profiles, returns map uuid -> first matching rule
+// Also returns allowlisted UUIDs, current is_bot flags of all profiles and, when scoring, all UUIDs values
+func detectBots(db *sql.DB, rules []*compiledBotRule, allow *compiledAllowlist, scoring bool) (bots map[string]botMatch, allowed map[string]struct{}, flags map[string]bool, values map[string]botValues) {
+	bots = make(map[string]botMatch)
+	allowed = make(map[string]struct{})
+	flags = make(map[string]bool)
+	values = make(map[string]botValues)
+	for uuid := range allow.uuids {
+		allowed[uuid] = struct{}{}
+	}
+	addValues := func(uuid string, username, name, email *string) {
+		v, ok := values[uuid]
+		if !ok {
+			v = make(botValues)
+			values[uuid] = v
+		}
+		v.add(cSignalUsername, username)
+		v.add(cSignalName, name)
+		v.add(cSignalEmail, email)
+	}
+	rows, err := db.Query("select uuid, source, username, name, email from identities")
+	fatalOnError(err)
+	var (
+		uuid      string
+		source    string
+		pusername *string
+		pemail    *string
+		pname     *string
+		pisBot    *int
+	)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&uuid, &source, &pusername, &pname, &pemail))
+		if allow.contains(allow.usernames, pusername) || allow.contains(allow.emails, pemail) {
+			allowed[uuid] = struct{}{}
+		}
+		if scoring {
+			addValues(uuid, pusername, pname, pemail)
+		}
+		_, ok := bots[uuid]
+		if ok {
+			continue
+		}
+		for _, rule := range rules {
+			field, value := rule.matchIdentity(source, pusername, pemail)
+			if field != "" {
+				bots[uuid] = botMatch{rule: rule.name, field: source + " " + field, value: value}
+				break
+			}
+		}
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	rows, err = db.Query("select uuid, name, email, is_bot from profiles")
+	fatalOnError(err)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&uuid, &pname, &pemail, &pisBot))
+		flags[uuid] = pisBot != nil && *pisBot != 0
+		if scoring {
+			addValues(uuid, nil, pname, pemail)
+		}
+		if pname == nil {
+			continue
+		}
+		if allow.contains(allow.profileNames, pname) {
+			allowed[uuid] = struct{}{}
+		}
+		_, ok := bots[uuid]
+		if ok {
+			continue
+		}
+		lName := strings.ToLower(*pname)
+		for _, rule := range rules {
+			_, ok := rule.profileNames[lName]
+			if ok {
+				bots[uuid] = botMatch{rule: rule.name, field: "profile name", value: *pname}
+				break
+			}
+		}
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	return
+}
+
+// loadBotsState - returns set of UUIDs marked as bots by json2hat, empty when there is no state file yet
+func loadBotsState(path string) map[string]struct{} {
+	uuids := make(map[string]struct{})
+	if path == "" {
+		return uuids
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Printf("No bots state found in %s\n", path)
+			return uuids
+		}
+		fatalOnError(err)
+	}
+	var state botsState
+	fatalOnError(json.Unmarshal(data, &state))
+	for _, uuid := range state.UUIDs {
+		uuids[uuid] = struct{}{}
+	}
+	return uuids
+}
+
+func saveBotsState(path string, uuids map[string]struct{}) {
+	state := botsState{UUIDs: []string{}}
+	for uuid := range uuids {
+		state.UUIDs = append(state.UUIDs, uuid)
+	}
+	sort.Strings(state.UUIDs)
+	data, err := json.MarshalIndent(state, "", "  ")
+	fatalOnError(err)
+	fatalOnError(ioutil.WriteFile(path, data, 0644))
+	fmt.Printf("Saved %d json2hat bots to bots state %s\n", len(state.UUIDs), path)
+}
+
+// setBotFlag - sets is_bot on given UUIDs profiles (only those having different value), returns number of updated profiles
+func setBotFlag(db *sql.DB, uuids []string, isBot int) (allUpdated int64) {
+	packSize := 1000
+	for from := 0; from < len(uuids); from += packSize {
+		to := from + packSize
+		if to > len(uuids) {
+			to = len(uuids)
+		}
+		args := []interface{}{isBot, isBot}
+		for _, uuid := range uuids[from:to] {
+			args = append(args, uuid)
+		}
+		query := "update profiles set is_bot = ? where (is_bot is null or is_bot != ?) and uuid in (" +
+			strings.Repeat("?,", to-from-1) + "?)"
+		res, err := db.Exec(query, args...)
+		fatalOnError(err)
+		updated, err := res.RowsAffected()
+		fatalOnError(err)
+		allUpdated += updated
+	}
+	return
+}
+
+// scoreBots - scores UUIDs not matched by any rule, adds those above threshold to bots
+// and writes borderline ones to BOT_REVIEW_CSV file (defaults to bot_review.csv)
+func scoreBots(scorer *botScorer, bots map[string]botMatch, values map[string]botValues, uuid2users map[string][]*gitHubUser, rep *runReport) {
+	for uuid, users := range uuid2users {
+		v, ok := values[uuid]
+		if !ok {
+			v = make(botValues)
+			values[uuid] = v
+		}
+		for _, user := range users {
+			v.add(cSignalUsername, &user.Login)
+			v.add(cSignalName, &user.Name)
+			v.add(cSignalAffiliation, &user.Affiliation)
+			for _, email := range user.emails() {
+				v.add(cSignalEmail, &email)
+			}
+		}
+	}
+	type reviewItem struct {
+		uuid     string
+		score    float64
+		evidence []string
+	}
+	review := []reviewItem{}
+	nScored := 0
+	for uuid, v := range values {
+		_, ok := bots[uuid]
+		if ok {
+			continue
+		}
+		score, evidence := scorer.score(v)
+		if score >= scorer.threshold {
+			bots[uuid] = botMatch{rule: "heuristic", field: strings.Join(evidence, " "), value: strconv.FormatFloat(score, 'f', 3, 64)}
+			nScored++
+			continue
+		}
+		if score >= scorer.review {
+			review = append(review, reviewItem{uuid: uuid, score: score, evidence: evidence})
+		}
+	}
+	// Most likely bots first
+	sort.Slice(review, func(i, j int) bool {
+		if review[i].score != review[j].score {
+			return review[i].score > review[j].score
+		}
+		return review[i].uuid < review[j].uuid
+	})
+	fmt.Printf("Heuristics marked %d UUIDs as bots, %d UUIDs to review\n", nScored, len(review))
+	rep.addSummary("Heuristic bots", nScored)
+	rep.addSummary("Bots to review", len(review))
+	reviewTable := rep.table("bot_review", "Possible bots to review", []string{"UUID", "Score", "Signals"})
+	for _, item := range review {
+		rep.addRow(reviewTable, item.uuid, strconv.FormatFloat(item.score, 'f', 3, 64), strings.Join(item.evidence, " "))
+	}
+	fileName := os.Getenv("BOT_REVIEW_CSV")
+	if fileName == "" {
+		fileName = "bot_review.csv"
+	}
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write(reviewTable.header))
+	for _, row := range reviewTable.rows {
+		fatalOnError(writer.Write(row))
+	}
+	writer.Flush()
+	fatalOnError(writer.Error())
+}
+
+// updateBots - marks profiles matching bot rules as bots (unless allowlisted), lists each affected UUID in report
+// BOTS_STATE=path stores UUIDs marked by json2hat, BOTS_CLEAR=1 clears is_bot of those that no longer match any rule
+// BOTS_DRY_RUN=1 only reports what would be done
+// When BOT_HEURISTICS is set, UUIDs not matching any rule are also scored using heuristic signals and their devstats data
+// (uuid2users), those with score above review threshold but below auto-flagging threshold are written to BOT_REVIEW_CSV
+func updateBots(db *sql.DB, rep *runReport, cfg *botConfig, uuid2users map[string][]*gitHubUser) {
+	statePath := os.Getenv("BOTS_STATE")
+	clear := os.Getenv("BOTS_CLEAR") != ""
+	dry := os.Getenv("BOTS_DRY_RUN") != ""
+	bots, allowed, flags, values := detectBots(db, cfg.rules, cfg.allow, cfg.scorer != nil)
+	if cfg.scorer != nil {
+		scoreBots(cfg.scorer, bots, values, uuid2users, rep)
+	}
+	state := loadBotsState(statePath)
+	botsTable := rep.table("bots", "Bot detection", []string{"UUID", "Action", "Rule", "Field", "Value"})
+	toSet, toClear := []string{}, []string{}
+	newState := make(map[string]struct{})
+	nAllowed := 0
+	for uuid, match := range bots {
+		_, ok := allowed[uuid]
+		if ok {
+			// Allowlisted profile is handled as not matching any rule
+			rep.addRow(botsTable, uuid, "allowed", match.rule, match.field, match.value)
+			nAllowed++
+			delete(bots, uuid)
+			continue
+		}
+		isBot, ok := flags[uuid]
+		if !ok {
+			continue
+		}
+		action := "already set"
+		if !isBot {
+			action = "set"
+			toSet = append(toSet, uuid)
+			newState[uuid] = struct{}{}
+		} else {
+			_, ok = state[uuid]
+			if ok {
+				newState[uuid] = struct{}{}
+			}
+		}
+		rep.addRow(botsTable, uuid, action, match.rule, match.field, match.value)
+	}
+	// Allowlisted profiles marked as bots by json2hat (like flagged before being allowlisted) are handled as no longer matching
+	for uuid := range state {
+		_, ok := bots[uuid]
+		if ok || !flags[uuid] {
+			continue
+		}
+		_, isAllowed := allowed[uuid]
+		if clear {
+			toClear = append(toClear, uuid)
+			action := "clear"
+			if isAllowed {
+				action = "clear allowlisted"
+			}
+			rep.addRow(botsTable, uuid, action, "", "", "")
+			continue
+		}
+		action := "no longer matching"
+		if isAllowed {
+			action = "allowlisted"
+		}
+		rep.addRow(botsTable, uuid, action, "", "", "")
+		newState[uuid] = struct{}{}
+	}
+	// Bot flags of allowlisted profiles not set by json2hat are never changed
+	for uuid := range allowed {
+		_, ok := state[uuid]
+		if !ok && flags[uuid] {
+			rep.addRow(botsTable, uuid, "allowlisted, flag not set by json2hat", "", "", "")
+		}
+	}
+	rep.sortTable(botsTable, 1, 0)
+	sort.Strings(toSet)
+	sort.Strings(toClear)
+	fmt.Printf("Detected %d bot profiles (%d allowlisted): %d to set, %d to clear\n", len(bots)+nAllowed, nAllowed, len(toSet), len(toClear))
+	rep.addSummary("Detected bots", len(bots))
+	rep.addSummary("Allowlisted bots", nAllowed)
+	if dry {
+		for _, uuid := range toSet {
+			fmt.Printf("Would set %s as bot: %+v\n", uuid, bots[uuid])
+		}
+		for _, uuid := range toClear {
+			fmt.Printf("Would clear %s bot flag\n", uuid)
+		}
+		rep.addSummary("Bots to set (dry run)", len(toSet))
+		rep.addSummary("Bots to clear (dry run)", len(toClear))
+		return
+	}
+	nSet := setBotFlag(db, toSet, 1)
+	nClear := setBotFlag(db, toClear, 0)
+	fmt.Printf("Set %d profiles as bots, cleared %d profiles bot flag\n", nSet, nClear)
+	rep.addSummary("Set as bots", nSet)
+	rep.addSummary("Cleared bots", nClear)
+	if statePath != "" {
+		saveBotsState(statePath, newState)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stampedResolver - project resolver that can tell if project data changed since the last run
+// slugStamps returns map slug -> stamp, stamp changes when project indices change
+type stampedResolver interface {
+	slugStamps(slugs []string) map[string]string
+}
+
+// configuredResolver - project resolver whose results depend on its configuration
+// config returns configuration key, cache is fully rebuilt when it changes
+type configuredResolver interface {
+	config() string
+}
+
+// projectsCache - UUIDs projects membership persisted between runs
+// UUIDs maps all already checked UUIDs to their project slugs and activity windows (can be empty)
+type projectsCache struct {
+	Resolver string                                `json:"resolver"`
+	Config   string                                `json:"config"`
+	Created  time.Time                             `json:"created"`
+	Stamps   map[string]string                     `json:"stamps"`
+	UUIDs    map[string]map[string]projectActivity `json:"uuids"`
+}
+
+// cachedResolver - wraps other project resolver and caches its results in a local file
+// Cache is fully rebuilt when older than ttl or when forced, otherwise only new UUIDs
+// and projects whose indices changed are refreshed
+type cachedResolver struct {
+	inner projectResolver
+	path  string
+	ttl   time.Duration
+	force bool
+}
+
+// getCachedResolver - PROJECTS_CACHE=path enables cache (ignored for sh resolver), PROJECTS_CACHE_TTL defaults to 168h
+// PROJECTS_CACHE_REBUILD=1 forces full cache rebuild
+func getCachedResolver(inner projectResolver) projectResolver {
+	path := os.Getenv("PROJECTS_CACHE")
+	if path == "" {
+		return inner
+	}
+	// Sorting Hat resolver has no stamps to detect changes and only reads local DB, so it is never cached
+	_, ok := inner.(*shResolver)
+	if ok {
+		fmt.Printf("Projects cache is not used with Sorting Hat project resolver\n")
+		return inner
+	}
+	r := &cachedResolver{
+		inner: inner,
+		path:  path,
+		ttl:   168 * time.Hour,
+		force: os.Getenv("PROJECTS_CACHE_REBUILD") != "",
+	}
+	sTTL := os.Getenv("PROJECTS_CACHE_TTL")
+	if sTTL != "" {
+		var err error
+		r.ttl, err = time.ParseDuration(sTTL)
+		fatalOnError(err)
+	}
+	return r
+}
+
+func (r *cachedResolver) name() string {
+	return r.inner.name() + " (cached in " + r.path + ")"
+}
+
+// config - returns inner resolver configuration key, empty when it has no configuration
+func (r *cachedResolver) config() string {
+	configured, ok := r.inner.(configuredResolver)
+	if !ok {
+		return ""
+	}
+	return configured.config()
+}
+
+// load - returns cache from file or an empty cache when there is no valid cache
+func (r *cachedResolver) load() *projectsCache {
+	empty := &projectsCache{
+		Resolver: r.inner.name(),
+		Config:   r.config(),
+		Created:  time.Now(),
+		Stamps:   make(map[string]string),
+		UUIDs:    make(map[string]map[string]projectActivity),
+	}
+	if r.force {
+		fmt.Printf("Forced projects cache rebuild\n")
+		return empty
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		fmt.Printf("No projects cache found in %s, full rebuild\n", r.path)
+		return empty
+	}
+	var cache projectsCache
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		fmt.Printf("Invalid projects cache in %s: %v, full rebuild\n", r.path, err)
+		return empty
+	}
+	if cache.Resolver != r.inner.name() {
+		fmt.Printf("Projects cache was created using %s resolver, full rebuild\n", cache.Resolver)
+		return empty
+	}
+	if cache.Config != r.config() {
+		fmt.Printf("Projects cache was created using different resolver configuration '%s', full rebuild\n", cache.Config)
+		return empty
+	}
+	if time.Since(cache.Created) > r.ttl {
+		fmt.Printf("Projects cache created %v is older than %v, full rebuild\n", cache.Created, r.ttl)
+		return empty
+	}
+	if cache.Stamps == nil {
+		cache.Stamps = make(map[string]string)
+	}
+	if cache.UUIDs == nil {
+		cache.UUIDs = make(map[string]map[string]projectActivity)
+	}
+	return &cache
+}
+
+func (r *cachedResolver) save(cache *projectsCache) {
+	data, err := json.Marshal(cache)
+	fatalOnError(err)
+	fatalOnError(ioutil.WriteFile(r.path, data, 0644))
+	fmt.Printf("Saved %d UUIDs and %d projects to projects cache %s\n", len(cache.UUIDs), len(cache.Stamps), r.path)
+}
+
+// uuidsProjects - stamps of slugs that could not be resolved are not saved, so they are refreshed on the next run
+func (r *cachedResolver) uuidsProjects(slugs []string, uuids map[string]struct{}) (map[string]map[string]projectActivity, stringSet) {
+	cache := r.load()
+	stamps := make(map[string]string)
+	stamped, ok := r.inner.(stampedResolver)
+	if ok {
+		stamps = stamped.slugStamps(slugs)
+	}
+	changed := make(map[string]struct{})
+	changedSlugs, unchangedSlugs := []string{}, []string{}
+	for _, slug := range slugs {
+		oldStamp, ok := cache.Stamps[slug]
+		if !ok || oldStamp != stamps[slug] {
+			changed[slug] = struct{}{}
+			changedSlugs = append(changedSlugs, slug)
+			continue
+		}
+		unchangedSlugs = append(unchangedSlugs, slug)
+	}
+	newUUIDs := make(map[string]struct{})
+	for uuid := range uuids {
+		_, ok := cache.UUIDs[uuid]
+		if !ok {
+			newUUIDs[uuid] = struct{}{}
+		}
+	}
+	fmt.Printf("Projects cache: %d/%d projects changed, %d/%d UUIDs new\n", len(changedSlugs), len(slugs), len(newUUIDs), len(uuids))
+	// Drop changed projects from all cached UUIDs, they are going to be refreshed for current UUIDs only,
+	// so UUIDs not used in this run are evicted and will be resolved as new UUIDs when used again
+	nEvicted := 0
+	for uuid, uuidSlugs := range cache.UUIDs {
+		_, current := uuids[uuid]
+		if !current && len(changedSlugs) > 0 {
+			delete(cache.UUIDs, uuid)
+			nEvicted++
+			continue
+		}
+		for slug := range uuidSlugs {
+			_, ok := changed[slug]
+			if ok {
+				delete(uuidSlugs, slug)
+			}
+		}
+	}
+	failed := make(stringSet)
+	if nEvicted > 0 {
+		fmt.Printf("Projects cache: evicted %d UUIDs not used in this run\n", nEvicted)
+	}
+	merge := func(m map[string]map[string]projectActivity, failedSlugs stringSet) {
+		for uuid, uuidSlugs := range m {
+			for slug, act := range uuidSlugs {
+				addActivity(cache.UUIDs, uuid, slug, act)
+			}
+		}
+		for slug := range failedSlugs {
+			failed[slug] = struct{}{}
+		}
+	}
+	if len(changedSlugs) > 0 {
+		merge(r.inner.uuidsProjects(changedSlugs, uuids))
+	}
+	if len(unchangedSlugs) > 0 && len(newUUIDs) > 0 {
+		merge(r.inner.uuidsProjects(unchangedSlugs, newUUIDs))
+	}
+	for uuid := range uuids {
+		_, ok := cache.UUIDs[uuid]
+		if !ok {
+			cache.UUIDs[uuid] = make(map[string]projectActivity)
+		}
+	}
+	for _, slug := range slugs {
+		_, ok := failed[slug]
+		if ok {
+			delete(cache.Stamps, slug)
+			continue
+		}
+		cache.Stamps[slug] = stamps[slug]
+	}
+	r.save(cache)
+	current := make(map[string]struct{})
+	for _, slug := range slugs {
+		current[slug] = struct{}{}
+	}
+	m := make(map[string]map[string]projectActivity)
+	for uuid := range uuids {
+		for slug, act := range cache.UUIDs[uuid] {
+			_, ok := current[slug]
+			if ok {
+				addActivity(m, uuid, slug, act)
+			}
+		}
+	}
+	return m, failed
+}
+
+// esSlugStamps - stamp of a project is a hash of its indices names and documents counts
+func esSlugStamps(es *esClient, cfg *esIndexConfig, slugs []string) map[string]string {
+	stamps := make(map[string]string)
+	for _, slug := range slugs {
+		entries := []string{}
+		failed := false
+		for _, source := range cfg.sources {
+			pattern := cfg.pattern(slug, source.name)
+			body, err := es.request("GET", "/_cat/indices/"+pattern+"?format=json&h=index,docs.count&expand_wildcards=open", "")
+			if err != nil {
+				fmt.Printf("Cannot get %s indices stamp: %v\n", slug, err)
+				failed = true
+				break
+			}
+			var indices []struct {
+				Index string `json:"index"`
+				Docs  string `json:"docs.count"`
+			}
+			err = json.Unmarshal(body, &indices)
+			if err != nil {
+				fmt.Printf("Cannot parse %s indices stamp: %v\n", slug, err)
+				failed = true
+				break
+			}
+			for _, index := range indices {
+				entries = append(entries, index.Index+":"+index.Docs)
+			}
+		}
+		if failed {
+			// Unique stamp never matches the stored one, so project is refreshed on the next run too
+			stamps[slug] = "failed:" + time.Now().String()
+			continue
+		}
+		sort.Strings(entries)
+		hash := sha256.Sum256([]byte(strings.Join(entries, ",")))
+		stamps[slug] = hex.EncodeToString(hash[:])
+	}
+	return stamps
+}
+
+func (r *esSQLResolver) config() string {
+	return r.cfg.key()
+}
+
+func (r *esSearchResolver) config() string {
+	return r.cfg.key()
+}
+
+func (r *esSQLResolver) slugStamps(slugs []string) map[string]string {
+	return esSlugStamps(r.es, r.cfg, slugs)
+}
+
+func (r *esSearchResolver) slugStamps(slugs []string) map[string]string {
+	return esSlugStamps(r.es, r.cfg, slugs)
+}
+
+// slugStamps - all projects change when mapping file is modified
+func (r *fileResolver) slugStamps(slugs []string) map[string]string {
+	stamp := ""
+	info, err := os.Stat(r.path)
+	if err == nil {
+		stamp = strconv.FormatInt(info.ModTime().UnixNano(), 10) + ":" + strconv.FormatInt(info.Size(), 10)
+	}
+	stamps := make(map[string]string)
+	for _, slug := range slugs {
+		stamps[slug] = stamp
+	}
+	return stamps
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// countryAliases - non-ISO 3166-1 alpha-2 codes commonly used instead of ISO ones and historical (transitionally
+// reserved) codes mapped to their current successors, when succession is unambiguous
+var countryAliases = map[string]string{
+	"uk": "gb", // United Kingdom
+	"el": "gr", // Greece (EU code)
+	"zr": "cd", // Zaire
+	"tp": "tl", // East Timor
+	"bu": "mm", // Burma
+	"dd": "de", // East Germany
+	"fx": "fr", // Metropolitan France
+}
+
+// countryNormalizer - validates country codes against Sorting Hat countries table
+// Codes are lower cased, trimmed and mapped using aliases, unknown codes are counted and reported once
+// When insert is set, missing countries found in names (code -> [name, alpha3]) are inserted into countries table
+type countryNormalizer struct {
+	codes   map[string]struct{}
+	aliases map[string]string
+	unknown map[string]int
+	aliased map[string]int
+	names   map[string][2]string
+	insert  bool
+	added   []string
+}
+
+// getCountryNormalizer - reads known country codes from Sorting Hat database
+// COUNTRY_ALIASES='from:to,...' adds or overrides built-in aliases
+// COUNTRIES_INSERT=1 inserts missing countries defined in COUNTRIES_CSV file (code,name,alpha3 rows)
+func getCountryNormalizer(db *sql.DB) *countryNormalizer {
+	fmt.Printf("Reading countries...\n")
+	c := &countryNormalizer{
+		codes:   make(map[string]struct{}),
+		aliases: make(map[string]string),
+		unknown: make(map[string]int),
+		aliased: make(map[string]int),
+		names:   make(map[string][2]string),
+		insert:  os.Getenv("COUNTRIES_INSERT") != "",
+	}
+	rows, err := db.Query("select code from countries")
+	fatalOnError(err)
+	var code string
+	for rows.Next() {
+		fatalOnError(rows.Scan(&code))
+		c.codes[strings.ToLower(code)] = struct{}{}
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	for from, to := range countryAliases {
+		c.aliases[from] = to
+	}
+	sAliases := os.Getenv("COUNTRY_ALIASES")
+	if sAliases != "" {
+		for _, alias := range strings.Split(sAliases, ",") {
+			ary := strings.Split(alias, ":")
+			if len(ary) != 2 || strings.TrimSpace(ary[0]) == "" || strings.TrimSpace(ary[1]) == "" {
+				fatalf("invalid country alias '%s', expected 'from:to'", alias)
+			}
+			c.aliases[strings.ToLower(strings.TrimSpace(ary[0]))] = strings.ToLower(strings.TrimSpace(ary[1]))
+		}
+	}
+	if !c.insert {
+		return c
+	}
+	path := os.Getenv("COUNTRIES_CSV")
+	if path == "" {
+		fatalf("COUNTRIES_INSERT requires COUNTRIES_CSV file with code,name,alpha3 rows")
+	}
+	file, err := os.Open(path)
+	fatalOnError(err)
+	defer func() { _ = file.Close() }()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+	records, err := reader.ReadAll()
+	fatalOnError(err)
+	for _, record := range records {
+		code := strings.ToLower(strings.TrimSpace(record[0]))
+		if code == "code" {
+			continue
+		}
+		if len(code) != 2 || len(strings.TrimSpace(record[2])) != 3 {
+			fatalf("%s: invalid country row %v, expected 2 letter code, name and 3 letter alpha3 code", path, record)
+		}
+		c.names[code] = [2]string{strings.TrimSpace(record[1]), strings.ToUpper(strings.TrimSpace(record[2]))}
+	}
+	fmt.Printf("Read %d countries from %s\n", len(c.names), path)
+	return c
+}
+
+// normalize - returns upper case Sorting Hat country code for a given code or false when it is unknown
+func (c *countryNormalizer) normalize(db *sql.DB, code string) (string, bool) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return "", false
+	}
+	alias, ok := c.aliases[code]
+	if ok {
+		c.aliased[code+" -> "+alias]++
+		code = alias
+	}
+	_, ok = c.codes[code]
+	if ok {
+		return strings.ToUpper(code), true
+	}
+	data, ok := c.names[code]
+	if c.insert && ok {
+		_, err := db.Exec("insert into countries(code, name, alpha3) values(?, ?, ?)", strings.ToUpper(code), data[0], data[1])
+		fatalOnError(err)
+		fmt.Printf("Added country %s (%s, %s)\n", strings.ToUpper(code), data[0], data[1])
+		c.codes[code] = struct{}{}
+		c.added = append(c.added, code)
+		return strings.ToUpper(code), true
+	}
+	c.unknown[code]++
+	return "", false
+}
+
+// report - prints and reports aggregated unknown and aliased country codes
+func (c *countryNormalizer) report(rep *runReport) {
+	table := rep.table("unknown_countries", "Unknown country codes", []string{"Code", "Count"})
+	codes := []string{}
+	for code := range c.unknown {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if c.unknown[codes[i]] != c.unknown[codes[j]] {
+			return c.unknown[codes[i]] > c.unknown[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+	for _, code := range codes {
+		n := c.unknown[code]
+		fmt.Printf("Sorting Hat database has no '%s' country code, skipped %d country code updates\n", code, n)
+		rep.addRow(table, code, strconv.Itoa(n))
+	}
+	aliases := []string{}
+	for alias := range c.aliased {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		fmt.Printf("Mapped country code %s %d times\n", alias, c.aliased[alias])
+	}
+	rep.addSummary("Unknown country codes", len(codes))
+	rep.addSummary("Added countries", len(c.added))
+}
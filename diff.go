@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Difference kinds
+const (
+	cDiffMissing = "missing"
+	cDiffExtra   = "extra"
+	cDiffCompany = "company"
+	cDiffDates   = "dates"
+)
+
+// orgNameMapper - maps company names using DA's map_org_names.yaml regexps (compiled once)
+type orgNameMapper struct {
+	res []*regexp.Regexp
+	to  []string
+}
+
+// newOrgNameMapper - compiles mappings, the same regexps are used by import via MariaDB regexp, invalid Go regexps are skipped
+func newOrgNameMapper(mapOrgNames *allMappings) *orgNameMapper {
+	m := &orgNameMapper{}
+	for _, mp := range mapOrgNames.Mappings {
+		re, err := regexp.Compile("(?i)" + strings.Replace(mp[0], "\\\\", "\\", -1))
+		if err != nil {
+			fmt.Printf("Skipping company name mapping '%s': %v\n", mp[0], err)
+			continue
+		}
+		m.res = append(m.res, re)
+		m.to = append(m.to, mp[1])
+	}
+	return m
+}
+
+// mapName - returns mapped company name or the original name when no mapping matches
+func (m *orgNameMapper) mapName(name string) string {
+	lName := strings.ToLower(name)
+	for i, re := range m.res {
+		if re.MatchString(lName) {
+			return m.to[i]
+		}
+	}
+	return name
+}
+
+// loadOrganizationNames - returns all Sorting Hat organizations names, map lower case name -> name
+func loadOrganizationNames(db *sql.DB) map[string]string {
+	rows, err := db.Query("select name from organizations")
+	fatalOnError(err)
+	var name string
+	names := make(map[string]string)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&name))
+		names[strings.ToLower(name)] = name
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	return names
+}
+
+// overlaps - checks if two periods overlap
+func overlaps(a, b orgEnrollment) bool {
+	return a.from.Before(b.to) && b.from.Before(a.to)
+}
+
+// diffPeriods - compares expected (devstats) and actual (Sorting Hat) enrollments of a single UUID
+// Returns differences as pairs of expected and actual enrollments, one of them can be nil
+func diffPeriods(expected, actual []orgEnrollment) (kinds []string, pairs [][2]*orgEnrollment, same int) {
+	usedExpected := make([]bool, len(expected))
+	usedActual := make([]bool, len(actual))
+	sameOrg := func(a, b orgEnrollment) bool {
+		return strings.EqualFold(a.org, b.org)
+	}
+	// Exact matches first, then the same company with different dates, then different company in overlapping period
+	passes := []struct {
+		kind  string
+		match func(e, a orgEnrollment) bool
+	}{
+		{"", func(e, a orgEnrollment) bool { return sameOrg(e, a) && e.from.Equal(a.from) && e.to.Equal(a.to) }},
+		{cDiffDates, func(e, a orgEnrollment) bool { return sameOrg(e, a) && overlaps(e, a) }},
+		{cDiffCompany, func(e, a orgEnrollment) bool { return !sameOrg(e, a) && overlaps(e, a) }},
+	}
+	for _, pass := range passes {
+		for i := range expected {
+			if usedExpected[i] {
+				continue
+			}
+			for j := range actual {
+				if usedActual[j] || !pass.match(expected[i], actual[j]) {
+					continue
+				}
+				usedExpected[i], usedActual[j] = true, true
+				if pass.kind == "" {
+					same++
+				} else {
+					kinds = append(kinds, pass.kind)
+					pairs = append(pairs, [2]*orgEnrollment{&expected[i], &actual[j]})
+				}
+				break
+			}
+		}
+	}
+	for i := range expected {
+		if !usedExpected[i] {
+			kinds = append(kinds, cDiffMissing)
+			pairs = append(pairs, [2]*orgEnrollment{&expected[i], nil})
+		}
+	}
+	for j := range actual {
+		if !usedActual[j] {
+			kinds = append(kinds, cDiffExtra)
+			pairs = append(pairs, [2]*orgEnrollment{nil, &actual[j]})
+		}
+	}
+	return
+}
+
+// diffAffs - compares devstats affiliations with Sorting Hat enrollments without changing anything
+// Users are matched the same way as in import, companies are mapped using acquisitions and (when not an existing
+// organization) DA's company names mappings
+// DIFF_SLUG - enrollments project slug to compare, defaults to the first foundation slug (like cncf-f), use "global" for NULL project slug
+// DIFF_FORMAT - comma separated list of: csv, json, md, defaults to csv; DIFF_PATH - output files prefix, defaults to "diff"
+func diffAffs(db *sql.DB, users *userStream, acqs *allAcquisitions, mapOrgNames *allMappings, foundations []*foundation) {
+	formats := parseReportFormats(os.Getenv("DIFF_FORMAT"))
+	if len(formats) == 0 {
+		formats = []string{"csv"}
+	}
+	prefix := os.Getenv("DIFF_PATH")
+	if prefix == "" {
+		prefix = "diff"
+	}
+	dbg := os.Getenv("DBG") != ""
+	onlyGGHUsername, onlyGGHName, nameMatch := getMatchOptions()
+	acqMap := getAcquisitionsMap(acqs)
+	comMap := make(map[string][2]string)
+	stat := make(map[string][2]int)
+	mapper := newOrgNameMapper(mapOrgNames)
+	orgNames := loadOrganizationNames(db)
+	// The same lookup order as import: existing organization first, DA's company names mappings only for new ones
+	orgName := func(company string) string {
+		name, ok := orgNames[strings.ToLower(company)]
+		if ok {
+			return name
+		}
+		return mapper.mapName(company)
+	}
+	defaultStartDate := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	defaultEndDate := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	idx := loadIdentities(db, onlyGGHUsername, onlyGGHName, os.Getenv("STRICT_MATCH") != "")
+	enrollments := loadEnrollments(db, getEnrollmentsSlug("DIFF_SLUG", foundations))
+	rep := newRunReport("json2hat diff report")
+	matches, nUnmatched, nUsers := matchUsers(idx, users, nameMatch, dbg, true, rep)
+
+	diffTable := rep.table(
+		"differences",
+		"Differences between devstats affiliations and Sorting Hat enrollments",
+		[]string{"Login", "UUID", "Difference", "Expected Company", "Expected From", "Expected To", "Actual Company", "Actual From", "Actual To"},
+	)
+	format := func(e *orgEnrollment) []string {
+		if e == nil {
+			return []string{"", "", ""}
+		}
+		return []string{e.org, e.from.Format("2006-01-02"), e.to.Format("2006-01-02")}
+	}
+	counts := make(map[string]int)
+	nSame, nUUIDs, nDiffUsers := 0, 0, 0
+	for _, match := range matches {
+		var expected []orgEnrollment
+		for _, aff := range parseAffiliations(match.user.Affiliation, defaultStartDate, defaultEndDate) {
+			company := orgName(mapCompanyName(comMap, acqMap, stat, aff.company))
+			expected = append(expected, orgEnrollment{org: company, from: aff.from, to: aff.to})
+		}
+		userDiffers := false
+		for _, uuid := range sortedUUIDs(match.uuids) {
+			nUUIDs++
+			kinds, pairs, same := diffPeriods(expected, enrollments[uuid])
+			nSame += same
+			for i, kind := range kinds {
+				counts[kind]++
+				row := []string{match.user.Login, uuid, kind}
+				row = append(row, format(pairs[i][0])...)
+				row = append(row, format(pairs[i][1])...)
+				rep.addRow(diffTable, row...)
+				userDiffers = true
+			}
+		}
+		if userDiffers {
+			nDiffUsers++
+		}
+	}
+	rep.sortTable(diffTable, 0, 1, 2)
+	fmt.Printf(
+		"Compared %d users (%d UUIDs): %d users differ, same: %d, missing: %d, extra: %d, different company: %d, different dates: %d\n",
+		len(matches), nUUIDs, nDiffUsers, nSame, counts[cDiffMissing], counts[cDiffExtra], counts[cDiffCompany], counts[cDiffDates],
+	)
+	rep.addSummary("Users", nUsers)
+	rep.addSummary("Unmatched users", nUnmatched)
+	rep.addSummary("Compared users", len(matches))
+	rep.addSummary("Compared UUIDs", nUUIDs)
+	rep.addSummary("Users with differences", nDiffUsers)
+	rep.addSummary("Same enrollments", nSame)
+	for _, kind := range []string{cDiffMissing, cDiffExtra, cDiffCompany, cDiffDates} {
+		rep.addSummary("Differences: "+kind, counts[kind])
+	}
+	writeReportFiles(rep, formats, prefix)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// esClient - ElasticSearch HTTP client
+// Supports basic auth, API key or bearer token, custom CA bundle, request timeout and retries
+type esClient struct {
+	url     string
+	client  *http.Client
+	user    string
+	pass    string
+	apiKey  string
+	token   string
+	retries int
+	backoff time.Duration
+}
+
+// newESClient - creates ES client, configuration is read from ES_* environment variables:
+// ES_USER/ES_PASS - basic auth, ES_API_KEY - API key auth, ES_TOKEN - bearer token auth
+// ES_CA_CERT - path to PEM CA bundle, ES_TIMEOUT - request timeout (like 30s, 5m), no timeout by default
+// ES_RETRIES - number of retries on network errors, 429 and 5xx statuses, defaults to 3
+// ES_RETRY_DELAY - initial retry delay doubled on each retry, defaults to 1s
+func newESClient(url string) *esClient {
+	c := &esClient{
+		url:     url,
+		client:  http.DefaultClient,
+		user:    os.Getenv("ES_USER"),
+		pass:    os.Getenv("ES_PASS"),
+		apiKey:  os.Getenv("ES_API_KEY"),
+		token:   os.Getenv("ES_TOKEN"),
+		retries: 3,
+		backoff: time.Second,
+	}
+	var err error
+	sRetries := os.Getenv("ES_RETRIES")
+	if sRetries != "" {
+		c.retries, err = strconv.Atoi(sRetries)
+		fatalOnError(err)
+	}
+	sDelay := os.Getenv("ES_RETRY_DELAY")
+	if sDelay != "" {
+		c.backoff, err = time.ParseDuration(sDelay)
+		fatalOnError(err)
+	}
+	caCert := os.Getenv("ES_CA_CERT")
+	sTimeout := os.Getenv("ES_TIMEOUT")
+	if caCert == "" && sTimeout == "" {
+		return c
+	}
+	c.client = &http.Client{}
+	if sTimeout != "" {
+		c.client.Timeout, err = time.ParseDuration(sTimeout)
+		fatalOnError(err)
+	}
+	if caCert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(caCert)
+		fatalOnError(err)
+		if !pool.AppendCertsFromPEM(data) {
+			fatalf("no certificates found in ES CA bundle %s", caCert)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		c.client.Transport = transport
+	}
+	return c
+}
+
+// setAuth - sets authorization header if any ES credentials are configured
+func (c *esClient) setAuth(req *http.Request) {
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.user != "":
+		req.SetBasicAuth(c.user, c.pass)
+	}
+}
+
+// retryable - network errors, 429 and 5xx statuses are retried
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// request - sends JSON data to a given ES path, returns response body, non 200 status is an error
+// Retries with exponential backoff on network errors, 429 and 5xx statuses
+func (c *esClient) request(method, path, data string) (body []byte, err error) {
+	delay := c.backoff
+	for try := 0; ; try++ {
+		var status int
+		body, status, err = c.requestOnce(method, path, data)
+		if err == nil || try >= c.retries || !retryable(status) {
+			return
+		}
+		fmt.Printf("ES request failed (try %d/%d), retrying in %v: %v\n", try+1, c.retries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (c *esClient) requestOnce(method, path, data string) (body []byte, status int, err error) {
+	url := c.url + path
+	var req *http.Request
+	req, err = http.NewRequest(method, url, bytes.NewReader([]byte(data)))
+	if err != nil {
+		err = fmt.Errorf("new request error: %+v for %s url: %s, data: %s", err, method, url, data)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.setAuth(req)
+	var resp *http.Response
+	resp, err = c.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("do request error: %+v for %s url: %s, data: %s", err, method, url, data)
+		return
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		err = fmt.Errorf("ReadAll non-ok request error: %+v for %s url: %s, data: %s", err, method, url, data)
+		return
+	}
+	status = resp.StatusCode
+	if status != 200 {
+		err = fmt.Errorf("Method:%s url:%s data: %s status:%d\n%s", method, url, data, status, body)
+		return
+	}
+	return
+}
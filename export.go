@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// orgEnrollment - single Sorting Hat enrollment with organization name
+type orgEnrollment struct {
+	org  string
+	from time.Time
+	to   time.Time
+}
+
+// exportProfile - Sorting Hat data of a single UUID needed to create devstats user entries
+type exportProfile struct {
+	logins      []string
+	emails      []string
+	name        string
+	country     *string
+	gender      *string
+	genderAcc   *int
+	enrollments []orgEnrollment
+}
+
+// emailEncode - encodes email the way devstats stores them: user!domain.com
+func emailEncode(email string) string {
+	return strings.Replace(email, "@", "!", -1)
+}
+
+// exportableEmail - checks if email can be encoded as devstats email and decoded back by import:
+// exactly one "@" and no "!", "," or whitespace (emails field is a comma separated list)
+func exportableEmail(email string) bool {
+	return strings.Count(email, "@") == 1 && !strings.ContainsAny(email, "!, \t\r\n")
+}
+
+// exportAffiliation - creates devstats affiliation string: "Company1 < 2015-01-01, Company2 < 2018-06-01, Company3"
+// Gaps between enrollments are exported as "(Unknown) < date", enrollments covered by previous ones are skipped
+// Returns "NotFound" when there are no enrollments
+func exportAffiliation(enrollments []orgEnrollment, defaultStartDate, defaultEndDate time.Time) (affiliation string, skipped int) {
+	if len(enrollments) == 0 {
+		return "NotFound", 0
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		if !enrollments[i].from.Equal(enrollments[j].from) {
+			return enrollments[i].from.Before(enrollments[j].from)
+		}
+		return enrollments[i].to.After(enrollments[j].to)
+	})
+	parts := []string{}
+	prevDate := defaultStartDate
+	for _, enrollment := range enrollments {
+		if !enrollment.to.After(prevDate) {
+			skipped++
+			continue
+		}
+		if enrollment.from.After(prevDate) {
+			parts = append(parts, "(Unknown) < "+enrollment.from.Format("2006-01-02"))
+		}
+		if !enrollment.to.Before(defaultEndDate) {
+			parts = append(parts, enrollment.org)
+			prevDate = defaultEndDate
+			break
+		}
+		parts = append(parts, enrollment.org+" < "+enrollment.to.Format("2006-01-02"))
+		prevDate = enrollment.to
+	}
+	affiliation = strings.Join(parts, ", ")
+	return
+}
+
+// getEnrollmentsSlug - returns enrollments project slug query parameter from a given env variable
+// Defaults to the first foundation slug (like cncf-f), "global" means NULL project slug
+func getEnrollmentsSlug(env string, foundations []*foundation) interface{} {
+	slug := os.Getenv(env)
+	switch slug {
+	case "":
+		return foundations[0].Slug
+	case "global":
+		return nil
+	}
+	return slug
+}
+
+// loadEnrollments - returns all enrollments with a given project slug, map uuid -> enrollments
+func loadEnrollments(db *sql.DB, projectSlug interface{}) map[string][]orgEnrollment {
+	fmt.Printf("Reading enrollments...\n")
+	rows, err := db.Query(
+		"select e.uuid, o.name, e.start, e.end from enrollments e, organizations o "+
+			"where e.organization_id = o.id and e.project_slug <=> ?",
+		projectSlug,
+	)
+	fatalOnError(err)
+	var (
+		uuid     string
+		org      string
+		from, to string
+	)
+	m := make(map[string][]orgEnrollment)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&uuid, &org, &from, &to))
+		// Skip fractional seconds of datetime(6) columns
+		m[uuid] = append(
+			m[uuid],
+			orgEnrollment{org: org, from: timeParseAny(strings.Split(from, ".")[0]), to: timeParseAny(strings.Split(to, ".")[0])},
+		)
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	return m
+}
+
+// exportAffs - exports Sorting Hat data into devstats github_users.json format, one entry per GitHub login
+// EXPORT_PATH - output file, defaults to github_users_export.json
+// EXPORT_SLUG - enrollments project slug to export, defaults to first foundation slug (like cncf-f), use "global" for NULL project slug
+// EXPORT_ALL=1 - also export users without enrollments (with "NotFound" affiliation)
+func exportAffs(db *sql.DB, foundations []*foundation) {
+	path := os.Getenv("EXPORT_PATH")
+	if path == "" {
+		path = "github_users_export.json"
+	}
+	projectSlug := getEnrollmentsSlug("EXPORT_SLUG", foundations)
+	exportAll := os.Getenv("EXPORT_ALL") != ""
+	defaultStartDate := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	defaultEndDate := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	profiles := make(map[string]*exportProfile)
+	get := func(uuid string) *exportProfile {
+		profile, ok := profiles[uuid]
+		if !ok {
+			profile = &exportProfile{}
+			profiles[uuid] = profile
+		}
+		return profile
+	}
+
+	fmt.Printf("Reading identities...\n")
+	rows, err := db.Query("select uuid, source, username, email from identities")
+	fatalOnError(err)
+	var (
+		uuid      string
+		source    string
+		pusername *string
+		pemail    *string
+	)
+	badEmails := 0
+	for rows.Next() {
+		fatalOnError(rows.Scan(&uuid, &source, &pusername, &pemail))
+		profile := get(uuid)
+		if source == "github" && pusername != nil && *pusername != "" {
+			profile.logins = append(profile.logins, *pusername)
+		}
+		if pemail != nil && strings.Contains(*pemail, "@") {
+			email := strings.ToLower(strings.TrimSpace(*pemail))
+			if exportableEmail(email) {
+				profile.emails = append(profile.emails, email)
+			} else {
+				badEmails++
+			}
+		}
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+
+	fmt.Printf("Reading profiles...\n")
+	rows, err = db.Query("select uuid, name, country_code, gender, gender_acc from profiles")
+	fatalOnError(err)
+	var (
+		pname      *string
+		pcountry   *string
+		pgender    *string
+		pgenderAcc *int
+	)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&uuid, &pname, &pcountry, &pgender, &pgenderAcc))
+		profile := get(uuid)
+		if pname != nil {
+			profile.name = *pname
+		}
+		profile.country, profile.gender, profile.genderAcc = pcountry, pgender, pgenderAcc
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+
+	nEnrollments := 0
+	for uuid, enrollments := range loadEnrollments(db, projectSlug) {
+		get(uuid).enrollments = enrollments
+		nEnrollments += len(enrollments)
+	}
+	fmt.Printf("Read %d enrollments of %d UUIDs\n", nEnrollments, len(profiles))
+
+	uuids := []string{}
+	for uuid := range profiles {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	users := gitHubUsers{}
+	logins := make(map[string]string)
+	noLogin, duplicated, skipped := 0, 0, 0
+	for _, uuid := range uuids {
+		profile := profiles[uuid]
+		if len(profile.enrollments) == 0 && !exportAll {
+			continue
+		}
+		if len(profile.logins) == 0 {
+			noLogin++
+			continue
+		}
+		affiliation, nSkipped := exportAffiliation(profile.enrollments, defaultStartDate, defaultEndDate)
+		skipped += nSkipped
+		emails := make(stringSet)
+		for _, email := range profile.emails {
+			emails[emailEncode(email)] = struct{}{}
+		}
+		sortedEmails := []string{}
+		for email := range emails {
+			sortedEmails = append(sortedEmails, email)
+		}
+		sort.Strings(sortedEmails)
+		user := gitHubUser{
+			Email:       strings.Join(sortedEmails, ","),
+			Affiliation: affiliation,
+			Name:        profile.name,
+		}
+		if profile.country != nil && *profile.country != "" {
+			country := strings.ToLower(*profile.country)
+			user.CountryID = &country
+		}
+		if profile.gender != nil && (*profile.gender == "male" || *profile.gender == "female") {
+			sex := (*profile.gender)[:1]
+			user.Sex = &sex
+			if profile.genderAcc != nil {
+				sexProb := float64(*profile.genderAcc) / 100.0
+				user.SexProb = &sexProb
+			}
+		}
+		for _, login := range profile.logins {
+			lLogin := strings.ToLower(login)
+			otherUUID, ok := logins[lLogin]
+			if ok {
+				if otherUUID != uuid {
+					fmt.Printf("GitHub login %s is used by %s and %s UUIDs, exporting only the first one\n", login, otherUUID, uuid)
+					duplicated++
+				}
+				continue
+			}
+			logins[lLogin] = uuid
+			user.Login = login
+			users = append(users, user)
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		return strings.ToLower(users[i].Login) < strings.ToLower(users[j].Login)
+	})
+	data, err := json.MarshalIndent(users, "", "  ")
+	fatalOnError(err)
+	fatalOnError(ioutil.WriteFile(path, data, 0644))
+	fmt.Printf(
+		"Exported %d users to %s, skipped %d UUIDs without GitHub login, %d duplicated logins, %d overlapping enrollments\n",
+		len(users), path, noLogin, duplicated, skipped,
+	)
+	if badEmails > 0 {
+		fmt.Printf("Skipped %d emails that cannot be stored in devstats email format\n", badEmails)
+	}
+}
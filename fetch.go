@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fetchMeta - cached remote file metadata used for conditional requests
+type fetchMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// sourceFetcher - downloads remote source files (github_users.json, companies.yaml, map_org_names.yaml)
+// Non 200 statuses are errors, network errors, 429 and 5xx statuses are retried
+// When cache directory is set, files are cached there and refreshed using ETag/If-Modified-Since
+type sourceFetcher struct {
+	client   *http.Client
+	cacheDir string
+	retries  int
+	backoff  time.Duration
+}
+
+// getSourceFetcher - creates remote files fetcher, configuration is read from FETCH_* environment variables:
+// FETCH_CACHE_DIR - cache directory (created when missing), no caching by default
+// FETCH_TIMEOUT - single request timeout (like 30s, 5m), defaults to 5m
+// FETCH_RETRIES - number of retries, defaults to 3, FETCH_RETRY_DELAY - initial retry delay doubled on each retry, defaults to 1s
+func getSourceFetcher() *sourceFetcher {
+	f := &sourceFetcher{
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		cacheDir: os.Getenv("FETCH_CACHE_DIR"),
+		retries:  3,
+		backoff:  time.Second,
+	}
+	var err error
+	sTimeout := os.Getenv("FETCH_TIMEOUT")
+	if sTimeout != "" {
+		f.client.Timeout, err = time.ParseDuration(sTimeout)
+		fatalOnError(err)
+	}
+	sRetries := os.Getenv("FETCH_RETRIES")
+	if sRetries != "" {
+		f.retries, err = strconv.Atoi(sRetries)
+		fatalOnError(err)
+	}
+	sDelay := os.Getenv("FETCH_RETRY_DELAY")
+	if sDelay != "" {
+		f.backoff, err = time.ParseDuration(sDelay)
+		fatalOnError(err)
+	}
+	if f.cacheDir != "" {
+		fatalOnError(os.MkdirAll(f.cacheDir, 0755))
+	}
+	return f
+}
+
+// cachePath - returns cache file path for a given URL: <url hash>-<file name>
+func (f *sourceFetcher) cachePath(url string) string {
+	hash := sha256.Sum256([]byte(url))
+	name := path.Base(strings.Split(url, "?")[0])
+	if name == "." || name == "/" {
+		name = "data"
+	}
+	return filepath.Join(f.cacheDir, hex.EncodeToString(hash[:8])+"-"+name)
+}
+
+// fetch - downloads a given URL into a local file and returns its path
+// temp is set when file is not cached and should be removed after use
+func (f *sourceFetcher) fetch(url string) (fPath string, temp bool, err error) {
+	var meta fetchMeta
+	metaPath := ""
+	if f.cacheDir != "" {
+		fPath = f.cachePath(url)
+		metaPath = fPath + ".meta"
+		data, err := ioutil.ReadFile(metaPath)
+		if err == nil {
+			_, err = os.Stat(fPath)
+		}
+		if err == nil && json.Unmarshal(data, &meta) == nil && meta.URL == url {
+			fmt.Printf("Found cached %s in %s\n", url, fPath)
+		} else {
+			meta = fetchMeta{}
+		}
+	}
+	delay := f.backoff
+	for try := 0; ; try++ {
+		var (
+			status int
+			tPath  string
+		)
+		tPath, status, err = f.fetchOnce(url, &meta)
+		if err == nil {
+			if status == http.StatusNotModified {
+				fmt.Printf("Remote %s not modified, using cached file %s\n", url, fPath)
+				return
+			}
+			if f.cacheDir == "" {
+				return tPath, true, nil
+			}
+			err = os.Rename(tPath, fPath)
+			if err != nil {
+				_ = os.Remove(tPath)
+				return
+			}
+			meta.URL = url
+			data, _ := json.Marshal(meta)
+			err = ioutil.WriteFile(metaPath, data, 0644)
+			return
+		}
+		if try >= f.retries || !retryable(status) {
+			return
+		}
+		fmt.Printf("Fetching %s failed (try %d/%d), retrying in %v: %v\n", url, try+1, f.retries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// fetchOnce - single conditional request, 200 response body is saved into a temporary file
+// When cached file metadata is known, 304 status is returned for unchanged file
+func (f *sourceFetcher) fetchOnce(url string, meta *fetchMeta) (tPath string, status int, err error) {
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	var resp *http.Response
+	resp, err = f.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("fetching %s: %v", url, err)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	status = resp.StatusCode
+	if status == http.StatusNotModified && (meta.ETag != "" || meta.LastModified != "") {
+		return
+	}
+	if status != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("fetching %s: unexpected status %d: %s", url, status, strings.TrimSpace(string(body)))
+		return
+	}
+	dir := f.cacheDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	file, err := ioutil.TempFile(dir, "json2hat-fetch-")
+	if err != nil {
+		return
+	}
+	tPath = file.Name()
+	n, err := io.Copy(file, resp.Body)
+	err2 := file.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("fetching %s: got %d bytes, expected %d", url, n, resp.ContentLength)
+	}
+	if err != nil {
+		_ = os.Remove(tPath)
+		tPath = ""
+		// Reading body failed, so it is a network error that can be retried
+		status = 0
+		return
+	}
+	meta.ETag = resp.Header.Get("ETag")
+	meta.LastModified = resp.Header.Get("Last-Modified")
+	fmt.Printf("Fetched %d bytes from %s\n", n, url)
+	return
+}
+
+// checkSHA256 - verifies data read from r against expected hex encoded SHA-256 sum, empty sum means no pinning
+func checkSHA256(source, expected string, r io.Reader) {
+	if expected == "" {
+		return
+	}
+	hash := sha256.New()
+	_, err := io.Copy(hash, r)
+	if err != nil {
+		fatalf("%s: %v", source, err)
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(actual, strings.TrimSpace(expected)) {
+		fatalf("%s: SHA-256 mismatch, expected %s, got %s", source, strings.TrimSpace(expected), actual)
+	}
+	fmt.Printf("%s: SHA-256 %s verified\n", source, actual)
+}
+
+// checkFileSHA256 - verifies file contents SHA-256 sum
+func checkFileSHA256(source, fPath, expected string) {
+	if expected == "" {
+		return
+	}
+	file, err := os.Open(fPath)
+	fatalOnError(err)
+	defer func() { _ = file.Close() }()
+	checkSHA256(source, expected, file)
+}
+
+// readSource - reads local file falling back to remote URL (when remoteURL is set and local file does not exist)
+// Returns data and source name (file path or URL), verifies SHA-256 when sha is set
+func readSource(localPath, remoteURL, sha string) ([]byte, string) {
+	if localPath != "" {
+		data, err := ioutil.ReadFile(localPath)
+		if err == nil {
+			checkSHA256(localPath, sha, bytes.NewReader(data))
+			fmt.Printf("Read %d bytes local data from %s\n", len(data), localPath)
+			return data, localPath
+		}
+		if !os.IsNotExist(err) || remoteURL == "" {
+			fatalOnError(err)
+		}
+	}
+	fPath, temp, err := getSourceFetcher().fetch(remoteURL)
+	fatalOnError(err)
+	if temp {
+		defer func() { _ = os.Remove(fPath) }()
+	}
+	data, err := ioutil.ReadFile(fPath)
+	fatalOnError(err)
+	checkSHA256(remoteURL, sha, bytes.NewReader(data))
+	fmt.Printf("Read %d bytes remote data from %s\n", len(data), remoteURL)
+	return data, remoteURL
+}
+
+// parseYAMLSource - parses YAML data, errors name the source and detect HTML pages returned instead of YAML
+func parseYAMLSource(data []byte, source string, v interface{}) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		fatalf("%s: not a valid YAML file, looks like HTML page", source)
+	}
+	err := yaml.Unmarshal(data, v)
+	if err != nil {
+		fatalf("%s: not a valid YAML file: %v", source, err)
+	}
+}
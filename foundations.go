@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// foundation - foundation configuration
+// Slug is a foundation-level enrollment project slug (like "cncf-f"), Prefix is its projects slugs prefix (like "cncf/")
+// FixturesPath is a fixtures directory within DA-api repo, FixturesDir is a local fixtures directory
+// SlugFile is a plain slug list file, AllUUIDs: write foundation-level enrollment for all matched UUIDs,
+// otherwise only for UUIDs that contributed to at least one foundation's project
+type foundation struct {
+	Name         string `yaml:"name"`
+	Slug         string `yaml:"slug"`
+	Prefix       string `yaml:"prefix"`
+	FixturesPath string `yaml:"fixtures_path"`
+	FixturesDir  string `yaml:"fixtures_dir"`
+	SlugFile     string `yaml:"slug_file"`
+	AllUUIDs     bool   `yaml:"all_uuids"`
+	slugs        []string
+}
+
+// allFoundations - foundations configuration YAML
+type allFoundations struct {
+	Foundations []*foundation `yaml:"foundations"`
+}
+
+// getFoundations - reads foundations from FOUNDATIONS_YAML file if set
+// Otherwise returns a single foundation configured by FOUNDATION_* variables, defaults to CNCF
+func getFoundations() (foundations []*foundation) {
+	path := os.Getenv("FOUNDATIONS_YAML")
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		fatalOnError(err)
+		var all allFoundations
+		fatalOnError(yaml.Unmarshal(data, &all))
+		foundations = all.Foundations
+	} else {
+		f := &foundation{
+			Name:         os.Getenv("FOUNDATION_NAME"),
+			Slug:         os.Getenv("FOUNDATION_SLUG"),
+			Prefix:       os.Getenv("FOUNDATION_PREFIX"),
+			FixturesPath: os.Getenv("SLUG_FIXTURES_PATH"),
+			FixturesDir:  os.Getenv("SLUG_FIXTURES_DIR"),
+			SlugFile:     os.Getenv("SLUG_FILE"),
+			AllUUIDs:     true,
+		}
+		if f.Name == "" {
+			f.Name = "CNCF"
+		}
+		if f.Slug == "" {
+			f.Slug = "cncf-f"
+		}
+		if f.Prefix == "" {
+			f.Prefix = "cncf/"
+		}
+		if f.FixturesPath == "" {
+			f.FixturesPath = "app/services/lf/bootstrap/fixtures/cncf"
+		}
+		foundations = append(foundations, f)
+	}
+	if len(foundations) == 0 {
+		fatalf("no foundations configured")
+	}
+	names := make(stringSet)
+	for _, f := range foundations {
+		if f.Name == "" || f.Slug == "" || f.Prefix == "" {
+			fatalf("foundation %+v must have name, slug and prefix", f)
+		}
+		_, ok := names[f.Name]
+		if ok {
+			fatalf("foundation %s is configured more than once", f.Name)
+		}
+		names[f.Name] = struct{}{}
+		if f.FixturesDir == "" {
+			f.FixturesDir = f.FixturesPath
+		}
+	}
+	return
+}
+
+// getFoundationsSlugs - gets all foundations project slugs using given slug provider
+func getFoundationsSlugs(provider slugProvider, foundations []*foundation) (allSlugs []string) {
+	cleaner, ok := provider.(interface{ cleanup() })
+	if ok {
+		defer cleaner.cleanup()
+	}
+	set := make(stringSet)
+	for _, f := range foundations {
+		slugs, err := provider.slugs(f)
+		fatalOnError(err)
+		for _, slug := range slugs {
+			if !strings.HasPrefix(slug, f.Prefix) {
+				fmt.Printf("Warning: %s project slug '%s' does not start with '%s'\n", f.Name, slug, f.Prefix)
+			}
+			_, ok := set[slug]
+			if ok {
+				continue
+			}
+			set[slug] = struct{}{}
+			f.slugs = append(f.slugs, slug)
+		}
+		fmt.Printf("Found %d %s projects using %s\n", len(f.slugs), f.Name, provider.name())
+	}
+	for slug := range set {
+		allSlugs = append(allSlugs, slug)
+	}
+	sort.Strings(allSlugs)
+	return
+}
+
+// Enrollment scopes
+const (
+	cScopeGlobal     = "global"
+	cScopeFoundation = "foundation"
+	cScopeProject    = "project"
+)
+
+// getEnrollmentScopes - ENROLLMENT_SCOPES is a comma separated list of: global, foundation, project
+// Defaults to "foundation,project"
+func getEnrollmentScopes() map[string]bool {
+	sScopes := os.Getenv("ENROLLMENT_SCOPES")
+	if sScopes == "" {
+		sScopes = cScopeFoundation + "," + cScopeProject
+	}
+	scopes := make(map[string]bool)
+	for _, scope := range strings.Split(sScopes, ",") {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		switch scope {
+		case "":
+			continue
+		case cScopeGlobal, cScopeFoundation, cScopeProject:
+			scopes[scope] = true
+		default:
+			fatalf("unknown enrollment scope: '%s', allowed: global, foundation, project", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		fatalf("no enrollment scopes specified")
+	}
+	return scopes
+}
+
+// enrollmentSlugs - returns all project slugs enrollment should be written for, depending on enrollment scopes
+// These are projects UUID contributed to, their foundations slugs and empty slug for global enrollment
+func enrollmentSlugs(uuid string, uuids2slugs map[string]map[string]projectActivity, foundations []*foundation, scopes map[string]bool) map[string]struct{} {
+	slugs := make(map[string]struct{})
+	if scopes[cScopeGlobal] {
+		slugs[""] = struct{}{}
+	}
+	if scopes[cScopeProject] {
+		for slug := range uuids2slugs[uuid] {
+			slugs[slug] = struct{}{}
+		}
+	}
+	if !scopes[cScopeFoundation] {
+		return slugs
+	}
+	for _, f := range foundations {
+		if f.AllUUIDs {
+			slugs[f.Slug] = struct{}{}
+			continue
+		}
+		for _, slug := range f.slugs {
+			_, ok := uuids2slugs[uuid][slug]
+			if ok {
+				slugs[f.Slug] = struct{}{}
+				break
+			}
+		}
+	}
+	return slugs
+}
+
+// enrollmentPeriod - enrollment start and end dates
+type enrollmentPeriod struct {
+	from time.Time
+	to   time.Time
+}
+
+// enrollmentPeriods - returns enrollment period for each given project slug
+// When clip is set, project-level enrollments are intersected with UUID's activity window in that project,
+// open-ended periods (ending at openEnd) keep their end date so ongoing contributions stay covered
+// Projects without overlap (including open-ended periods starting after the last activity) are skipped, projects with unknown activity window keep the original period
+func enrollmentPeriods(uuid string, from, to, openEnd time.Time, slugs map[string]struct{}, uuids2slugs map[string]map[string]projectActivity, clip bool) (periods map[string]enrollmentPeriod, nClipped, nSkipped int) {
+	periods = make(map[string]enrollmentPeriod)
+	for slug := range slugs {
+		period := enrollmentPeriod{from: from, to: to}
+		act, ok := uuids2slugs[uuid][slug]
+		if !clip || !ok || act.First.IsZero() || act.Last.IsZero() {
+			periods[slug] = period
+			continue
+		}
+		if act.Last.Before(period.from) {
+			nSkipped++
+			continue
+		}
+		if act.First.After(period.from) {
+			period.from = act.First
+		}
+		if to.Before(openEnd) && act.Last.Before(period.to) {
+			period.to = act.Last
+		}
+		if !period.from.Before(period.to) {
+			nSkipped++
+			continue
+		}
+		if !period.from.Equal(from) || !period.to.Equal(to) {
+			nClipped++
+		}
+		periods[slug] = period
+	}
+	return
+}
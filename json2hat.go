@@ -4,10 +4,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/csv"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
@@ -20,8 +17,6 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/pkg/errors"
-	yaml "gopkg.in/yaml.v2"
 )
 
 const cOrigin = "json2hat"
@@ -33,7 +28,7 @@ type native struct {
 	Slug string `yaml:"slug"`
 }
 
-// fixtureData - we only need to parse CNCF project slug
+// fixtureData - we only need to parse project slug
 type fixtureData struct {
 	Native native `yaml:"native"`
 }
@@ -42,15 +37,39 @@ type fixtureData struct {
 type gitHubUsers []gitHubUser
 
 // gitHubUser - single GitHug user entry from cncf/devstats `github_users.json` JSON.
+// Email can contain multiple comma separated emails, PreviousLogins is an optional list of former GitHub logins.
 type gitHubUser struct {
-	Login       string   `json:"login"`
-	Email       string   `json:"email"`
-	Affiliation string   `json:"affiliation"`
-	Name        string   `json:"name"`
-	CountryID   *string  `json:"country_id"`
-	Sex         *string  `json:"sex"`
-	Tz          *string  `json:"tz"`
-	SexProb     *float64 `json:"sex_prob"`
+	Login          string   `json:"login"`
+	Email          string   `json:"email"`
+	Affiliation    string   `json:"affiliation"`
+	Name           string   `json:"name"`
+	CountryID      *string  `json:"country_id"`
+	Sex            *string  `json:"sex"`
+	Tz             *string  `json:"tz"`
+	SexProb        *float64 `json:"sex_prob"`
+	PreviousLogins []string `json:"previous_logins,omitempty"`
+}
+
+// emails - returns all non-empty emails from a comma separated email field
+func (u *gitHubUser) emails() (emails []string) {
+	for _, email := range strings.Split(u.Email, ",") {
+		email = strings.TrimSpace(email)
+		if email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return
+}
+
+// logins - returns current login followed by all previous logins
+func (u *gitHubUser) logins() (logins []string) {
+	for _, login := range append([]string{u.Login}, u.PreviousLogins...) {
+		login = strings.TrimSpace(login)
+		if login != "" {
+			logins = append(logins, login)
+		}
+	}
+	return
 }
 
 // affData - holds single affiliation data
@@ -113,16 +132,13 @@ func timeParseAny(dtStr string) time.Time {
 	return time.Now()
 }
 
-func jsonEscape(str string) string {
-	b, _ := json.Marshal(str)
-	return string(b[1 : len(b)-1])
-}
-
-func execCommand(cmdAndArgs []string, env map[string]string) (string, string) {
+// execCommand - runs command with additional env in a given directory (current directory when empty)
+// Returns stdout, stderr and error which includes stderr output when command fails
+func execCommand(cmdAndArgs []string, env map[string]string, dir string) (string, string, error) {
 	command := cmdAndArgs[0]
 	arguments := cmdAndArgs[1:]
-	//fmt.Printf("%s %+v\n", command, arguments)
 	cmd := exec.Command(command, arguments...)
+	cmd.Dir = dir
 	if len(env) > 0 {
 		newEnv := os.Environ()
 		for key, value := range env {
@@ -136,228 +152,92 @@ func execCommand(cmdAndArgs []string, env map[string]string) (string, string) {
 	)
 	cmd.Stderr = &stdErr
 	cmd.Stdout = &stdOut
-	fatalOnError(cmd.Start())
-	fatalOnError(cmd.Wait())
-	return stdOut.String(), stdErr.String()
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("%s %s: %v: %s", command, strings.Join(arguments, " "), err, stdErr.String())
+	}
+	return stdOut.String(), stdErr.String(), err
 }
 
-func getUUIDsProjects(es string, slugs []string, uuids map[string]struct{}, dbg bool) (m map[string]map[string]struct{}) {
-	m = make(map[string]map[string]struct{})
-	fetchSize := 20000
-	termsSize := 0xffff
-	slug2pattern := make(map[string]string)
-	pattern2slug := make(map[string]string)
-	for _, slug := range slugs {
-		pattern := "sds-" + strings.Replace(slug, "/", "-", -1) + "-git*,-*-for-merge,-*-raw"
-		slug2pattern[slug] = pattern
-		pattern2slug[pattern] = slug
+// getMatchOptions - returns ONLY_GGH_USERNAME, ONLY_GGH_USER and NAME_MATCH matching options
+func getMatchOptions() (onlyGGHUsername, onlyGGHName bool, nameMatch int) {
+	if os.Getenv("ONLY_GGH_USERNAME") != "" {
+		onlyGGHUsername = true
 	}
-	thrN := runtime.NumCPU()
-	runtime.GOMAXPROCS(thrN)
-	//thrN = int(math.Round(math.Sqrt(float64(thrN))))
-	thrN /= 4
-	if thrN < 1 {
-		thrN = 1
+	if os.Getenv("ONLY_GGH_USER") != "" {
+		onlyGGHName = true
 	}
-	uuidsConds := []string{}
-	nUUIDs := len(uuids)
-	nConds := nUUIDs / termsSize
-	if nUUIDs%termsSize != 0 {
-		nConds++
+	sNameMatch := os.Getenv("NAME_MATCH")
+	if sNameMatch != "" {
+		var e error
+		nameMatch, e = strconv.Atoi(sNameMatch)
+		fatalOnError(e)
 	}
-	uuidsAry := []string{}
-	for uuid := range uuids {
-		uuidsAry = append(uuidsAry, uuid)
-	}
-	for i := 0; i < nConds; i++ {
-		uuidsCond := "author_uuid in ("
-		from := i * termsSize
-		to := from + termsSize
-		if to > nUUIDs {
-			to = nUUIDs
-		}
-		for j := from; j < to; j++ {
-			uuidsCond += "'" + uuidsAry[j] + "',"
-		}
-		uuidsCond = uuidsCond[0:len(uuidsCond)-1] + ")"
-		uuidsConds = append(uuidsConds, uuidsCond)
-	}
-	fmt.Printf("UUIDs processing in %d packs\n", len(uuidsConds))
-	var mMtx *sync.Mutex
-	if thrN > 1 {
-		mMtx = &sync.Mutex{}
-	}
-	processSlug := func(ch chan error, es, slug, pattern, cond string) (err error) {
-		if ch != nil {
-			defer func() {
-				if err != nil {
-					err = errors.Wrap(err, "processSlug: "+slug)
-				}
-				ch <- err
-			}()
-		}
-		if dbg {
-			fmt.Printf("Processing: %s <--> %s\n", slug, pattern)
-		}
-		data := fmt.Sprintf(
-			`{"query":"select author_uuid from \"%s\" where author_uuid is not null and author_uuid != '' and `+cond+` group by author_uuid","fetch_size":%d}`,
-			jsonEscape(pattern),
-			fetchSize,
-		)
-		payloadBytes := []byte(data)
-		payloadBody := bytes.NewReader(payloadBytes)
-		method := "POST"
-		url := fmt.Sprintf("%s/_sql?format=json", es)
-		var req *http.Request
-		req, err = http.NewRequest(method, url, payloadBody)
-		if err != nil {
-			err = fmt.Errorf("new request error: %+v for %s url: %s, data: %s", err, method, url, data)
-			return
-		}
-		req.Header.Set("Content-Type", "application/json")
-		var resp *http.Response
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			err = fmt.Errorf("do request error: %+v for %s url: %s, data: %s", err, method, url, data)
-			return
-		}
-		var body []byte
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			err = fmt.Errorf("ReadAll non-ok request error: %+v for %s url: %s, data: %s", err, method, url, data)
-			return
-		}
-		_ = resp.Body.Close()
-		if resp.StatusCode != 200 {
-			err = fmt.Errorf("Method:%s url:%s data: %s status:%d\n%s", method, url, data, resp.StatusCode, body)
-			return
-		}
-		type uuidsResult struct {
-			Cursor string     `json:"cursor"`
-			Rows   [][]string `json:"rows"`
-		}
-		var result uuidsResult
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			err = fmt.Errorf("Unmarshal error: %+v", err)
-			return
-		}
-		slugUUIDs := []string{}
-		for _, row := range result.Rows {
-			slugUUIDs = append(slugUUIDs, row[0])
+	return
+}
+
+// getAcquisitionsMap - compiles and validates companies acquisitions, returns map regexp -> company
+func getAcquisitionsMap(acqs *allAcquisitions) map[*regexp.Regexp]string {
+	var re *regexp.Regexp
+	acqMap := make(map[*regexp.Regexp]string)
+	srcMap := make(map[string]string)
+	resMap := make(map[string]struct{})
+	idxMap := make(map[*regexp.Regexp]int)
+	for idx, acq := range acqs.Acquisitions {
+		re = regexp.MustCompile(acq[0])
+		res, ok := srcMap[acq[0]]
+		if ok {
+			fatalf("Acquisition number %d '%+v' is already present in the mapping and maps into '%s'", idx, acq, res)
 		}
-		if len(result.Rows) == 0 {
-			return
+		srcMap[acq[0]] = acq[1]
+		_, ok = resMap[acq[1]]
+		if ok {
+			fatalf("Acquisition number %d '%+v': some other acquisition already maps into '%s', merge them", idx, acq, acq[1])
 		}
-		for {
-			data = `{"cursor":"` + result.Cursor + `"}`
-			payloadBytes = []byte(data)
-			payloadBody = bytes.NewReader(payloadBytes)
-			req, err = http.NewRequest(method, url, payloadBody)
-			if err != nil {
-				err = fmt.Errorf("new request error: %+v for %s url: %s, data: %s", err, method, url, data)
-				return
-			}
-			req.Header.Set("Content-Type", "application/json")
-			resp, err = http.DefaultClient.Do(req)
-			if err != nil {
-				err = fmt.Errorf("do request error: %+v for %s url: %s, data: %s", err, method, url, data)
-				return
-			}
-			body, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				err = fmt.Errorf("ReadAll non-ok request error: %+v for %s url: %s, data: %s", err, method, url, data)
-				return
-			}
-			_ = resp.Body.Close()
-			if resp.StatusCode != 200 {
-				err = fmt.Errorf("Method:%s url:%s data: %s status:%d\n%s", method, url, data, resp.StatusCode, body)
-				return
-			}
-			err = json.Unmarshal(body, &result)
-			if err != nil {
-				err = fmt.Errorf("Unmarshal error: %+v", err)
-				return
-			}
-			if len(result.Rows) == 0 {
-				break
-			}
-			for _, row := range result.Rows {
-				slugUUIDs = append(slugUUIDs, row[0])
+		resMap[acq[1]] = struct{}{}
+		acqMap[re] = acq[1]
+		idxMap[re] = idx
+	}
+	for re, res := range acqMap {
+		i := idxMap[re]
+		for idx, acq := range acqs.Acquisitions {
+			if re.MatchString(acq[1]) && i != idx {
+				fatalf("Acquisition's number %d '%s' result '%s' matches other acquisition number %d '%s' which maps to '%s', simplify it: '%v' -> '%s'", idx, acq[0], acq[1], i, re, res, acq[0], res)
 			}
-		}
-		url = fmt.Sprintf("%s/_sql/close", es)
-		data = `{"cursor":"` + result.Cursor + `"}`
-		payloadBytes = []byte(data)
-		payloadBody = bytes.NewReader(payloadBytes)
-		req, err = http.NewRequest(method, url, payloadBody)
-		if err != nil {
-			err = fmt.Errorf("new request error: %+v for %s url: %s, data: %s", err, method, url, data)
-			return
-		}
-		req.Header.Set("Content-Type", "application/json")
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			err = fmt.Errorf("do request error: %+v for %s url: %s, data: %s", err, method, url, data)
-			return
-		}
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			err = fmt.Errorf("ReadAll non-ok request error: %+v for %s url: %s, data: %s", err, method, url, data)
-			return
-		}
-		_ = resp.Body.Close()
-		if resp.StatusCode != 200 {
-			err = fmt.Errorf("Method:%s url:%s data: %s status:%d\n%s", method, url, data, resp.StatusCode, body)
-			return
-		}
-		// fmt.Printf("%s --> %d uuids\n", slug, len(slugUUIDs))
-		if mMtx != nil {
-			mMtx.Lock()
-			defer mMtx.Unlock()
-		}
-		for _, uuid := range slugUUIDs {
-			_, ok := m[uuid]
-			if !ok {
-				m[uuid] = make(map[string]struct{})
+			if re.MatchString(acq[0]) && res != acq[1] {
+				fatalf("Acquisition's number %d '%s' regexp '%s' matches other acquisition number %d '%s' which maps to '%s': result is different '%s'", idx, acq, acq[0], i, re, res, acq[1])
 			}
-			m[uuid][slug] = struct{}{}
 		}
+	}
+	return acqMap
+}
+
+// parseAffiliations - parses devstats affiliation string: "Company1 < 2015-01-01, Company2 < 2018-06-01, Company3"
+// Returns companies periods (without uuid), unknown periods are skipped
+func parseAffiliations(affs string, defaultStartDate, defaultEndDate time.Time) (periods []affData) {
+	if affs == "NotFound" || affs == "(Unknown)" || affs == "?" || affs == "-" || affs == "" {
 		return
 	}
-	fmt.Printf("Using %d threads to process %d CNCF projects and %d UUIDs\n", thrN, len(slugs), len(uuids))
-	if thrN > 1 {
-		ch := make(chan error)
-		nThreads := 0
-		for _, slug := range slugs {
-			for _, uuidsCond := range uuidsConds {
-				pattern := slug2pattern[slug]
-				go func(ch chan error, es, slug, pattern, uuidsCond string) {
-					_ = processSlug(ch, es, slug, pattern, uuidsCond)
-				}(ch, es, slug, pattern, uuidsCond)
-				nThreads++
-				if nThreads == thrN {
-					err := <-ch
-					if err != nil {
-						fmt.Printf("%+v\n", err)
-					}
-					nThreads--
-				}
-			}
-		}
-		for nThreads > 0 {
-			<-ch
-			nThreads--
+	prevDate := defaultStartDate
+	for _, aff := range strings.Split(affs, ", ") {
+		var dtFrom, dtTo time.Time
+		ary := strings.Split(aff, " < ")
+		company := strings.TrimSpace(ary[0])
+		if len(ary) > 1 {
+			// "company < date" form
+			dtFrom = prevDate
+			dtTo = timeParseAny(ary[1])
+		} else {
+			// "company" form
+			dtFrom = prevDate
+			dtTo = defaultEndDate
 		}
-	} else {
-		for _, slug := range slugs {
-			for _, uuidsCond := range uuidsConds {
-				err := processSlug(nil, es, slug, slug2pattern[slug], uuidsCond)
-				if err != nil {
-					fmt.Printf("%+v\n", err)
-				}
-			}
+		prevDate = dtTo
+		// Unknown periods (also written by export command for gaps between enrollments)
+		if company == "" || company == "NotFound" || company == "(Unknown)" || company == "?" || company == "-" {
+			continue
 		}
+		periods = append(periods, affData{company: company, from: dtFrom, to: dtTo})
 	}
 	return
 }
@@ -397,89 +277,30 @@ func mapCompanyName(comMap map[string][2]string, acqMap map[*regexp.Regexp]strin
 	return company
 }
 
-func updateProfile(db *sql.DB, uuid string, user *gitHubUser, countryCodes map[string]struct{}) bool {
-	var cols []string
-	var args []interface{}
-	if user.Sex != nil && (*user.Sex == "m" || *user.Sex == "f") {
-		gender := "male"
-		if *user.Sex == "f" {
-			gender = "female"
-		}
-		cols = append(cols, "gender = ?")
-		args = append(args, gender)
-	}
-	if user.SexProb != nil {
-		cols = append(cols, "gender_acc = ?")
-		args = append(args, int(*user.SexProb*100.0))
-	}
-	if user.CountryID != nil {
-		_, ok := countryCodes[strings.ToLower(*user.CountryID)]
-		if !ok {
-			fmt.Printf("Sorting Hat database has no '%s' country code, skipping country code update\n", *user.CountryID)
-		} else {
-			cols = append(cols, "country_code = ?")
-			args = append(args, strings.ToUpper(*user.CountryID))
-		}
-	}
-	if len(cols) > 0 {
-		query := strings.Join(cols, ", ")
-		query = "update profiles set " + query + " where uuid = ?"
-		args = append(args, uuid)
-		res, err := db.Exec(query, args...)
-		if err != nil {
-			fmt.Printf("%s %+v\n", query, args)
-		}
-		fatalOnError(err)
-		count, err := res.RowsAffected()
-		fatalOnError(err)
-		return count > 0
-	}
-	return false
-}
-
-func updateBots(db *sql.DB) {
-	query := "update profiles set is_bot = 1 " +
-		"where uuid in (select distinct uuid from identities where (" +
-		"username like 'ti-srebot' or username like 'nsmbot' or username like 'svcbot-qecnsdp' or " +
-		"username like 'cf-buildpacks-eng' or username like 'bosh-ci-push-pull' or username like 'gprasath' or " +
-		"username like 'zephyr-github' or username like 'zephyrbot' or username like 'strimzi-ci' or " +
-		"username like 'athenabot' or username like 'k8s-reviewable' or username like 'codecov-io' or " +
-		"username like 'grpc-testing' or username like 'k8s-teamcity-mesosphere' or username like 'angular-builds' or " +
-		"username like 'devstats-sync' or username like 'googlebot' or username like 'hibernate-ci' or " +
-		"username like 'coveralls' or username like 'rktbot' or username like 'coreosbot' or username like 'web-flow' or " +
-		"username like 'prometheus-roobot' or username like 'cncf-bot' or username like 'kernelprbot' or " +
-		"username like 'istio-testing' or username like 'spinnakerbot' or username like 'pikbot' or " +
-		"username like 'spinnaker-release' or username like 'golangcibot' or username like 'opencontrail-ci-admin' or " +
-		"username like 'titanium-octobot' or username like 'asfgit' or username like 'appveyorbot' or " +
-		"username like 'cadvisorjenkinsbot' or username like 'gitcoinbot' or username like 'katacontainersbot' or " +
-		"username like 'prombot' or username like 'prowbot' or username like 'travis%bot' or username like 'k8s-%' or " +
-		"username like '%-bot' or username like '%-robot' or username like 'bot-%' or username like 'robot-%' or " +
-		"username like '%[bot]%' or username like '%[robot]%' or username like '%-jenkins' or username like 'jenkins-%' or " +
-		"username like '%-ci%bot' or username like '%-testing' or username like 'codecov-%' or username like '%clabot%' or " +
-		"username like '%cla-bot%' or username like '%-gerrit' or username like '%-bot-%' or " +
-		"username like '%envoy-filter-example%' or username like '%cibot' or username like '%-ci') " +
-		"and source like 'git%')"
-	res, err := db.Exec(query)
-	if err != nil {
-		fmt.Printf("%s\n", query)
-	}
-	fatalOnError(err)
-	count, err := res.RowsAffected()
-	fatalOnError(err)
-	fmt.Printf("Set %d profiles as bots (using identity username)\n", count)
-	query = "update profiles set is_bot = 1 where name in (" +
-		"'envoy-filter-example(CircleCI)', 'envoy-docs(travis)', 'data-plane-api(CircleCI)', " +
-		"'go-control-plane(CircleCI)', 'Kubernetes Publisher')"
-	res, err = db.Exec(query)
-	if err != nil {
-		fmt.Printf("%s\n", query)
+// unmatchedReason - explains why devstats user was not matched to any Sorting Hat identity
+func unmatchedReason(user *gitHubUser, nameMatch, nameHits int) string {
+	reasons := []string{}
+	if user.Email == "" {
+		reasons = append(reasons, "no email")
+	} else {
+		reasons = append(reasons, "no email hit")
 	}
-	fatalOnError(err)
-	count, err = res.RowsAffected()
-	fatalOnError(err)
-	fmt.Printf("Set %d profiles as bots (using profile name)\n", count)
-	// select p.uuid, p.name, p.email, p.is_bot, i.name, i.email, i.username, i.source
-	// from identities i, profiles p where i.uuid = p.uuid and i.uuid in (select uuid from profiles where name in (...));
+	if user.Login == "" {
+		reasons = append(reasons, "no login")
+	} else {
+		reasons = append(reasons, "no username hit")
+	}
+	switch {
+	case nameMatch == 0:
+		reasons = append(reasons, "name matching disabled")
+	case user.Name == "":
+		reasons = append(reasons, "no name")
+	case nameHits == 0:
+		reasons = append(reasons, "no name hit")
+	default:
+		reasons = append(reasons, fmt.Sprintf("name ambiguous: %d UUIDs", nameHits))
+	}
+	return strings.Join(reasons, ", ")
 }
 
 func addOrganization(db *sql.DB, companyName, lCompanyName string, mapOrgNames *allMappings, oname2id, cache map[string]int, missingOrgs map[string]int, orgsRO bool, thrN int, mtx *sync.Mutex) int {
@@ -580,22 +401,22 @@ func addOrganization(db *sql.DB, companyName, lCompanyName string, mapOrgNames *
 	return id
 }
 
-func addEnrollment(db *sql.DB, uuid string, companyID int, from, to time.Time, m map[string]map[string]struct{}, replace bool) bool {
-	slugs, ok := m[uuid]
-	if !ok {
-		slugs = make(map[string]struct{})
-		// slugs["cncf-f"] = struct{}{}
-		// return false
-	}
-	slugs["cncf-f"] = struct{}{}
-	for slug := range slugs {
+// addEnrollment - adds enrollment for all given project slugs and their periods, empty slug means global enrollment (NULL project_slug)
+func addEnrollment(db *sql.DB, uuid string, companyID int, periods map[string]enrollmentPeriod, replace bool) bool {
+	added := false
+	for slug, period := range periods {
 		var (
 			dummy int
 			err   error
 		)
+		from, to := period.from, period.to
+		var projectSlug interface{} = slug
+		if slug == "" {
+			projectSlug = nil
+		}
 		if !replace {
 			var rows *sql.Rows
-			rows, err = db.Query("select 1 from enrollments where uuid = ? and start = ? and end = ? and organization_id = ? and project_slug = ?", uuid, from, to, companyID, slug)
+			rows, err = db.Query("select 1 from enrollments where uuid = ? and start = ? and end = ? and organization_id = ? and project_slug <=> ?", uuid, from, to, companyID, projectSlug)
 			fatalOnError(err)
 			for rows.Next() {
 				fatalOnError(rows.Scan(&dummy))
@@ -604,18 +425,20 @@ func addEnrollment(db *sql.DB, uuid string, companyID int, from, to time.Time, m
 			fatalOnError(rows.Close())
 		}
 		if dummy == 1 {
-			return false
+			continue
 		}
-		_, err = db.Exec("delete from enrollments where uuid = ? and start = ? and end = ? and project_slug = ?", uuid, from, to, slug)
+		_, err = db.Exec("delete from enrollments where uuid = ? and start = ? and end = ? and project_slug <=> ?", uuid, from, to, projectSlug)
 		fatalOnError(err)
-		_, err = db.Exec("insert into enrollments(uuid, start, end, organization_id, project_slug) values(?, ?, ?, ?, ?)", uuid, from, to, companyID, slug)
+		_, err = db.Exec("insert into enrollments(uuid, start, end, organization_id, project_slug) values(?, ?, ?, ?, ?)", uuid, from, to, companyID, projectSlug)
 		// FIXME
 		//fatalOnError(err)
 		if err != nil {
 			fmt.Printf("failed: %v, args: (%s, %v, %v, %d, %s)\n", err, uuid, from, to, companyID, slug)
+			continue
 		}
+		added = true
 	}
-	return true
+	return added
 }
 
 func updateIdentities(db *sql.DB, uuids map[string]struct{}) int64 {
@@ -666,7 +489,7 @@ func updateIdentities(db *sql.DB, uuids map[string]struct{}) int64 {
 	return allUpdated
 }
 
-func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNames *allMappings, esURL string, cncfSlugs []string) {
+func importAffs(db *sql.DB, users *userStream, acqs *allAcquisitions, mapOrgNames *allMappings, resolver projectResolver, foundations []*foundation, slugs []string, botRules *botConfig) {
 	// Process acquisitions
 	// fmt.Printf("Acquisitions: %+v\n", acqs.Acquisitions)
 	fmt.Printf("Acquisitions: %d\n", len(acqs.Acquisitions))
@@ -680,14 +503,7 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 	if os.Getenv("DBG") != "" {
 		dbg = true
 	}
-	onlyGGHUsername := false
-	if os.Getenv("ONLY_GGH_USERNAME") != "" {
-		onlyGGHUsername = true
-	}
-	onlyGGHName := false
-	if os.Getenv("ONLY_GGH_USER") != "" {
-		onlyGGHName = true
-	}
+	onlyGGHUsername, onlyGGHName, nameMatch := getMatchOptions()
 	replace := false
 	if os.Getenv("REPLACE") != "" {
 		replace = true
@@ -696,107 +512,17 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 	if os.Getenv("DRY_RUN") != "" {
 		dry = true
 	}
-	nameMatch := 0
-	sNameMatch := os.Getenv("NAME_MATCH")
-	if sNameMatch != "" {
-		var e error
-		nameMatch, e = strconv.Atoi(sNameMatch)
-		fatalOnError(e)
-	}
-	var re *regexp.Regexp
-	acqMap = make(map[*regexp.Regexp]string)
+	acqMap = getAcquisitionsMap(acqs)
 	comMap = make(map[string][2]string)
 	stat = make(map[string][2]int)
-	srcMap := make(map[string]string)
-	resMap := make(map[string]struct{})
-	idxMap := make(map[*regexp.Regexp]int)
-	for idx, acq := range acqs.Acquisitions {
-		re = regexp.MustCompile(acq[0])
-		res, ok := srcMap[acq[0]]
-		if ok {
-			fatalf("Acquisition number %d '%+v' is already present in the mapping and maps into '%s'", idx, acq, res)
-		}
-		srcMap[acq[0]] = acq[1]
-		_, ok = resMap[acq[1]]
-		if ok {
-			fatalf("Acquisition number %d '%+v': some other acquisition already maps into '%s', merge them", idx, acq, acq[1])
-		}
-		resMap[acq[1]] = struct{}{}
-		acqMap[re] = acq[1]
-		idxMap[re] = idx
-	}
-	for re, res := range acqMap {
-		i := idxMap[re]
-		for idx, acq := range acqs.Acquisitions {
-			if re.MatchString(acq[1]) && i != idx {
-				fatalf("Acquisition's number %d '%s' result '%s' matches other acquisition number %d '%s' which maps to '%s', simplify it: '%v' -> '%s'", idx, acq[0], acq[1], i, re, res, acq[0], res)
-			}
-			if re.MatchString(acq[0]) && res != acq[1] {
-				fatalf("Acquisition's number %d '%s' regexp '%s' matches other acquisition number %d '%s' which maps to '%s': result is different '%s'", idx, acq, acq[0], i, re, res, acq[1])
-			}
-		}
-	}
 
 	if dry {
 		fmt.Printf("Exiting due to dry-run mode\n")
 		return
 	}
 
-	// Eventually clean affiliations data
-	if os.Getenv("SH_CLEANUP") != "" {
-		_, err := db.Exec("delete from enrollments where project_slug like 'cncf/%' or project_slug = 'cncf-f'")
-		fatalOnError(err)
-		_, err = db.Exec("delete from organizations")
-		fatalOnError(err)
-		fmt.Printf("Current affiliation data cleaned.\n")
-	}
-
 	// Fetch existing identities
-	fmt.Printf("Reading existing identities...\n")
-	rows, err := db.Query("select uuid, email, username, name, source from identities")
-	fatalOnError(err)
-	var (
-		uuid      string
-		email     string
-		name      string
-		username  string
-		pemail    *string
-		pusername *string
-		pname     *string
-		source    string
-	)
-	email2uuid := make(map[string]map[string]struct{})
-	username2uuid := make(map[string]map[string]struct{})
-	name2uuid := make(map[string]map[string]struct{})
-	for rows.Next() {
-		fatalOnError(rows.Scan(&uuid, &pemail, &pusername, &pname, &source))
-		if pemail != nil {
-			email = *pemail
-			_, ok := email2uuid[email]
-			if !ok {
-				email2uuid[email] = make(map[string]struct{})
-			}
-			email2uuid[email][uuid] = struct{}{}
-		}
-		if pusername != nil && (!onlyGGHUsername || source == cGit || source == cGitHub) {
-			username = *pusername
-			_, ok := username2uuid[username]
-			if !ok {
-				username2uuid[username] = make(map[string]struct{})
-			}
-			username2uuid[username][uuid] = struct{}{}
-		}
-		if pname != nil && (!onlyGGHName || source == cGit || source == cGitHub) {
-			name = *pname
-			_, ok := name2uuid[name]
-			if !ok {
-				name2uuid[name] = make(map[string]struct{})
-			}
-			name2uuid[name][uuid] = struct{}{}
-		}
-	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
+	idx := loadIdentities(db, onlyGGHUsername, onlyGGHName, os.Getenv("STRICT_MATCH") != "")
 
 	testConnect := os.Getenv("SH_TEST_CONNECT")
 	if testConnect != "" {
@@ -804,39 +530,12 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 		return
 	}
 
-	// Fetch current organizations
-	fmt.Printf("Reading existing organizations...\n")
-	rows, err = db.Query("select id, name from organizations")
-	fatalOnError(err)
-	var id int
-	oname2id := make(map[string]int)
-	for rows.Next() {
-		fatalOnError(rows.Scan(&id, &name))
-		oname2id[strings.ToLower(name)] = id
-	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
-
 	// Fetch known country codes
-	fmt.Printf("Reading countries...\n")
-	countryCodes := make(map[string]struct{})
-	rows, err = db.Query("select code from countries")
-	fatalOnError(err)
-	var code string
-	for rows.Next() {
-		fatalOnError(rows.Scan(&code))
-		countryCodes[strings.ToLower(code)] = struct{}{}
-	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
+	countries := getCountryNormalizer(db)
 
 	// Process all JSON entries
-	noProfileUpdate := false
-	noProfileUpdateS := os.Getenv("NO_PROFILE_UPDATE")
-	if noProfileUpdateS != "" {
-		noProfileUpdate = true
-	}
 	orgsRO := os.Getenv("ORGS_RO") != ""
+	scopes := getEnrollmentScopes()
 	defaultStartDate := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
 	defaultEndDate := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
 	companies := make(stringSet)
@@ -846,48 +545,19 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 	updatedProfiles := make(map[string]struct{})
 	notUpdatedProfiles := make(map[string]struct{})
 	allUUIDs := make(map[string]struct{})
-	nUsr := len(*users)
+	rep := newRunReport("json2hat import report")
+	profiles := getProfileUpdater(db, countries, rep)
+	noProfileUpdate := profiles == nil
+	matches, nUnmatched, nUsr := matchUsers(idx, users, nameMatch, dbg, len(getReportFormats()) > 0, rep)
+	nMatches := len(matches)
 	fmt.Printf("Processing JSON...\n")
-	for ui, user := range *users {
-		if ui > 0 && ((noProfileUpdate && ui%20000 == 0) || (!noProfileUpdate && ui%1000 == 0)) {
-			fmt.Printf("Processing JSON %d/%d\n", ui, nUsr)
+	for mi, match := range matches {
+		if mi > 0 && ((noProfileUpdate && mi%20000 == 0) || (!noProfileUpdate && mi%1000 == 0)) {
+			fmt.Printf("Processing JSON %d/%d\n", mi, nMatches)
 		}
-		// Email decode ! --> @
-		user.Email = strings.ToLower(emailDecode(user.Email))
-		email := user.Email
-		login := user.Login
-		name := user.Name
+		user := match.user
+		uuids := match.uuids
 		// Update profiles
-		uuids := make(map[string]struct{})
-		uuida, ok := email2uuid[email]
-		if dbg {
-			fmt.Printf("email: %s --> %v/%v\n", email, uuida, ok)
-		}
-		if ok {
-			for uuid := range uuida {
-				uuids[uuid] = struct{}{}
-			}
-		}
-		uuida, ok = username2uuid[login]
-		if dbg {
-			fmt.Printf("username: %s --> %v/%v\n", login, uuida, ok)
-		}
-		if ok {
-			for uuid := range uuida {
-				uuids[uuid] = struct{}{}
-			}
-		}
-		if nameMatch > 0 {
-			uuida, ok = name2uuid[name]
-			if dbg {
-				fmt.Printf("name: %s --> %v/%v\n", name, uuida, ok)
-			}
-			if ok && (nameMatch > 1 || (nameMatch == 1 && len(uuida) == 1)) {
-				for uuid := range uuida {
-					uuids[uuid] = struct{}{}
-				}
-			}
-		}
 		if len(uuids) > 0 {
 			if dbg {
 				fmt.Printf("Final uuids: %v\n", uuids)
@@ -896,7 +566,7 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 				allUUIDs[uuid] = struct{}{}
 				updated := false
 				if !noProfileUpdate {
-					updated = updateProfile(db, uuid, &user, countryCodes)
+					updated = profiles.update(db, uuid, &user)
 				}
 				if updated {
 					updatedProfiles[uuid] = struct{}{}
@@ -906,43 +576,32 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 			}
 			hits++
 			// Affiliations
-			affs := user.Affiliation
-			if affs == "NotFound" || affs == "(Unknown)" || affs == "?" || affs == "-" || affs == "" {
-				continue
-			}
-			affsAry := strings.Split(affs, ", ")
-			prevDate := defaultStartDate
-			for _, aff := range affsAry {
-				var dtFrom, dtTo time.Time
-				ary := strings.Split(aff, " < ")
-				company := strings.TrimSpace(ary[0])
-				if len(ary) > 1 {
-					// "company < date" form
-					dtFrom = prevDate
-					dtTo = timeParseAny(ary[1])
-				} else {
-					// "company" form
-					dtFrom = prevDate
-					dtTo = defaultEndDate
-				}
-				if company == "" {
-					continue
-				}
+			for _, aff := range parseAffiliations(user.Affiliation, defaultStartDate, defaultEndDate) {
 				// Map using companies acquisitions/company names mapping
-				company = mapCompanyName(comMap, acqMap, stat, company)
+				company := mapCompanyName(comMap, acqMap, stat, aff.company)
 				companies[company] = struct{}{}
 				for uuid := range uuids {
-					affList = append(affList, affData{uuid: uuid, company: company, from: dtFrom, to: dtTo})
+					affList = append(affList, affData{uuid: uuid, company: company, from: aff.from, to: aff.to})
 					allAffs++
 				}
-				prevDate = dtTo
 			}
 		}
 	}
 	// fmt.Printf("affList: %+v\ncompanies: %+v\n", affList, companies)
 	// fmt.Printf("oname2id: %+v\ncompanies: %+v\n", oname2id, companies)
 	fmt.Printf("All UUIDs: %d\n", len(allUUIDs))
-	uuids2slugs := getUUIDsProjects(esURL, cncfSlugs, allUUIDs, dbg)
+	// Projects membership is not needed when only global and all UUIDs foundations enrollments are written
+	needProjects := scopes[cScopeProject]
+	for _, f := range foundations {
+		if scopes[cScopeFoundation] && !f.AllUUIDs {
+			needProjects = true
+		}
+	}
+	uuids2slugs := make(map[string]map[string]projectActivity)
+	if needProjects {
+		fmt.Printf("Resolving UUIDs projects using %s\n", resolver.name())
+		uuids2slugs, _ = resolver.uuidsProjects(slugs, allUUIDs)
+	}
 	counts := make(map[int]int)
 	for _, slugs := range uuids2slugs {
 		count := len(slugs)
@@ -970,6 +629,34 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 	}
 	fmt.Printf("%d uuids not found\n", miss)
 
+	// Eventually clean affiliations data, only after all users are matched and projects are resolved
+	// (sh resolver reads current foundations enrollments), so broken input never leaves cleaned data behind
+	if os.Getenv("SH_CLEANUP") != "" {
+		for _, f := range foundations {
+			_, err := db.Exec("delete from enrollments where project_slug like ? or project_slug = ?", f.Prefix+"%", f.Slug)
+			fatalOnError(err)
+		}
+		_, err := db.Exec("delete from organizations")
+		fatalOnError(err)
+		fmt.Printf("Current affiliation data cleaned.\n")
+	}
+
+	// Fetch current organizations
+	fmt.Printf("Reading existing organizations...\n")
+	rows, err := db.Query("select id, name from organizations")
+	fatalOnError(err)
+	var (
+		id   int
+		name string
+	)
+	oname2id := make(map[string]int)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&id, &name))
+		oname2id[strings.ToLower(name)] = id
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+
 	// Add companies
 	thrN := runtime.NumCPU()
 	thrN /= 4
@@ -1011,6 +698,8 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 	missingEnrollments := make(map[string]struct{})
 	nAffs := len(affList)
 	missRols := 0
+	clip := os.Getenv("CLIP_TO_ACTIVITY") != ""
+	clippedEnrollments, skippedEnrollments := 0, 0
 	for i, aff := range affList {
 		uuid := aff.uuid
 		if aff.company == "" {
@@ -1022,7 +711,10 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 			fatalf("company not found: " + aff.company)
 		}
 		if companyID >= 0 {
-			updated := addEnrollment(db, uuid, companyID, aff.from, aff.to, uuids2slugs, replace)
+			periods, nClipped, nSkipped := enrollmentPeriods(uuid, aff.from, aff.to, defaultEndDate, enrollmentSlugs(uuid, uuids2slugs, foundations, scopes), uuids2slugs, clip)
+			clippedEnrollments += nClipped
+			skippedEnrollments += nSkipped
+			updated := addEnrollment(db, uuid, companyID, periods, replace)
 			if updated {
 				updatedEnrollments[uuid] = struct{}{}
 			} else {
@@ -1040,6 +732,9 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 	if missRols > 0 {
 		fmt.Printf("Skipped %d enrollments\n", missRols)
 	}
+	if clip {
+		fmt.Printf("Clipped %d project enrollments to activity dates, skipped %d outside of activity dates\n", clippedEnrollments, skippedEnrollments)
+	}
 
 	// Gather uuids updated and update their 'last_modified' date on 'identities' table
 	updatedUuids := make(map[string]struct{})
@@ -1075,26 +770,57 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 		len(missingEnrollments),
 		len(notUpdatedUuids),
 	)
+	rep.addSummary("Users", nUsr)
+	rep.addSummary("Hits", hits)
+	rep.addSummary("Unmatched users", nUnmatched)
+	rep.addSummary("Affiliations", allAffs)
+	rep.addSummary("Companies", len(companies))
+	rep.addSummary("Updated profiles", len(updatedProfiles))
+	if !noProfileUpdate {
+		profiles.report()
+	}
+	countries.report(rep)
+	rep.addSummary("Updated enrollments", len(updatedEnrollments))
+	rep.addSummary("Updated UUIDs", len(updatedUuids))
+	rep.addSummary("Actual updates", updates)
+	rep.addSummary("Not updated profiles", len(notUpdatedProfiles))
+	rep.addSummary("Not updated enrollments", len(notUpdatedEnrollments))
+	rep.addSummary("Missing enrollments", len(missingEnrollments))
+	if clip {
+		rep.addSummary("Clipped project enrollments", clippedEnrollments)
+		rep.addSummary("Project enrollments outside of activity dates", skippedEnrollments)
+	}
+	rep.addSummary("Not updated UUIDs", len(notUpdatedUuids))
+	rep.addSummary("Missing organizations", len(missingOrgs))
+	statTable := rep.table("mapping_stats", "Company mapping stats", []string{"Company", "Checked regexp", "Cache hit"})
 	for company, data := range stat {
 		if company == "---" {
 			fmt.Printf("Non-acquired companies: checked all regexp: %d, cache hit: %d\n", data[0], data[1])
 		} else {
 			fmt.Printf("Mapped to '%s': checked regexp: %d, cache hit: %d\n", company, data[0], data[1])
 		}
+		rep.addRow(statTable, company, strconv.Itoa(data[0]), strconv.Itoa(data[1]))
 	}
+	rep.sortTable(statTable, 0)
+	mapTable := rep.table("used_mappings", "Used company mappings", []string{"Company", "Mapped To"})
 	for company, data := range comMap {
 		if data[1] == "u" {
 			continue
 		}
 		fmt.Printf("Used mapping '%s' --> '%s'\n", company, data[0])
+		rep.addRow(mapTable, company, data[0])
 	}
-	skipBots := false
-	if os.Getenv("SKIP_BOTS") != "" {
-		skipBots = true
-	}
-	if !skipBots {
-		updateBots(db)
+	rep.sortTable(mapTable, 0)
+	if botRules != nil {
+		uuid2users := make(map[string][]*gitHubUser)
+		for i := range matches {
+			for uuid := range matches[i].uuids {
+				uuid2users[uuid] = append(uuid2users[uuid], &matches[i].user)
+			}
+		}
+		updateBots(db, rep, botRules, uuid2users)
 	}
+	missTable := rep.table("missing_orgs", "Missing organizations", []string{"Organization Name", "Number of References"})
 	if len(missingOrgs) > 0 {
 		m := make(map[int][]string)
 		for org, n := range missingOrgs {
@@ -1125,10 +851,12 @@ func importAffs(db *sql.DB, users *gitHubUsers, acqs *allAcquisitions, mapOrgNam
 			ns := strconv.Itoa(n)
 			for _, org := range orgs {
 				err = writer.Write([]string{org, ns})
+				rep.addRow(missTable, org, ns)
 			}
 		}
 		writer.Flush()
 	}
+	writeReport(rep)
 }
 
 // getConnectString - get MariaDB SH (Sorting Hat) database DSN
@@ -1185,149 +913,91 @@ func getConnectString() string {
 	return dsn
 }
 
-// getAffiliationsJSONBody - get affiliations JSON contents
-// First try to get JSON from SH_LOCAL_JSON_PATH which defaults to "github_users.json"
-// Fallback to SH_REMOTE_JSON_PATH which defaults to "https://github.com/cncf/devstats/raw/master/github_users.json"
-func getAffiliationsJSONBody() []byte {
-	jsonLocalPath := os.Getenv("SH_LOCAL_JSON_PATH")
-	if jsonLocalPath == "" {
-		jsonLocalPath = "github_users.json"
-	}
-	data, err := ioutil.ReadFile(jsonLocalPath)
-	if err != nil {
-		switch err := err.(type) {
-		case *os.PathError:
-			jsonRemotePath := os.Getenv("SH_REMOTE_JSON_PATH")
-			if jsonRemotePath == "" {
-				jsonRemotePath = "https://github.com/cncf/devstats/raw/master/github_users.json"
-			}
-			response, err2 := http.Get(jsonRemotePath)
-			fatalOnError(err2)
-			defer func() { _ = response.Body.Close() }()
-			data, err2 = ioutil.ReadAll(response.Body)
-			fatalOnError(err2)
-			fmt.Printf("Read %d bytes remote JSON data from %s\n", len(data), jsonRemotePath)
-			return data
-		default:
-			fatalOnError(err)
-		}
-	}
-	fmt.Printf("Read %d bytes local JSON data from %s\n", len(data), jsonLocalPath)
-	return data
-}
-
-// getAcquisitionsYAMLBody - get company acquisitions and name mappings YAML body
+// getAcquisitionsYAMLBody - get company acquisitions and name mappings YAML body and its source
 // First try to get YAML from SH_LOCAL_YAML_PATH which defaults to "companies.yaml"
 // Fallback to SH_REMOTE_YAML_PATH which defaults to "https://github.com/cncf/devstats/raw/master/companies.yaml"
-func getAcquisitionsYAMLBody() []byte {
+// SH_YAML_SHA256 - optional expected SHA-256 sum of the YAML file
+func getAcquisitionsYAMLBody() ([]byte, string) {
 	yamlLocalPath := os.Getenv("SH_LOCAL_YAML_PATH")
 	if yamlLocalPath == "" {
 		yamlLocalPath = "companies.yaml"
 	}
-	data, err := ioutil.ReadFile(yamlLocalPath)
-	if err != nil {
-		switch err := err.(type) {
-		case *os.PathError:
-			yamlRemotePath := os.Getenv("SH_REMOTE_YAML_PATH")
-			if yamlRemotePath == "" {
-				yamlRemotePath = "https://github.com/cncf/devstats/raw/master/companies.yaml"
-			}
-			response, err2 := http.Get(yamlRemotePath)
-			fatalOnError(err2)
-			defer func() { _ = response.Body.Close() }()
-			data, err2 = ioutil.ReadAll(response.Body)
-			fatalOnError(err2)
-			fmt.Printf("Read %d bytes remote YAML data from %s\n", len(data), yamlRemotePath)
-			return data
-		default:
-			fatalOnError(err)
-		}
+	yamlRemotePath := os.Getenv("SH_REMOTE_YAML_PATH")
+	if yamlRemotePath == "" {
+		yamlRemotePath = "https://github.com/cncf/devstats/raw/master/companies.yaml"
 	}
-	fmt.Printf("Read %d bytes local YAML data from %s\n", len(data), yamlLocalPath)
-	return data
-}
-
-// getMapOrgNamesYAMLBody - get map organization names YAML body
-func getMapOrgNamesYAMLBody() []byte {
-	yamlRemotePath := "https://github.com/LF-Engineering/dev-analytics-affiliation/raw/master/map_org_names.yaml"
-	response, err := http.Get(yamlRemotePath)
-	fatalOnError(err)
-	defer func() { _ = response.Body.Close() }()
-	data, err := ioutil.ReadAll(response.Body)
-	fatalOnError(err)
-	fmt.Printf("Read %d bytes remote YAML data from %s\n", len(data), yamlRemotePath)
-	return data
+	return readSource(yamlLocalPath, yamlRemotePath, os.Getenv("SH_YAML_SHA256"))
 }
 
-func getCNCFSlugs(repoURL string) (slugs []string, err error) {
-	cmd := []string{"git", "clone", "--single-branch", "--branch", "prod", repoURL}
-	env := map[string]string{"GIT_TERMINAL_PROMPT": "0"}
-	_, _ = execCommand(cmd, env)
-	defer func() {
-		_, _ = execCommand([]string{"rm", "-rf", "dev-analytics-api"}, nil)
-	}()
-	var fns string
-	fns, _ = execCommand([]string{"ls", "./dev-analytics-api/app/services/lf/bootstrap/fixtures/cncf"}, nil)
-	fna := strings.Split(fns, "\n")
-	for _, fn := range fna {
-		fn = strings.TrimSpace(fn)
-		if fn == "" {
-			continue
-		}
-		fn = "./dev-analytics-api/app/services/lf/bootstrap/fixtures/cncf/" + fn
-		var data []byte
-		data, err = ioutil.ReadFile(fn)
-		fatalOnError(err)
-		var fixture fixtureData
-		err = yaml.Unmarshal(data, &fixture)
-		if fixture.Native.Slug == "" {
-			fatalf("fixture %+v has no slug", fixture)
-		}
-		slugs = append(slugs, fixture.Native.Slug)
+// getMapOrgNamesYAMLBody - get map organization names YAML body and its source
+// MAP_ORG_NAMES_PATH - optional local file, MAP_ORG_NAMES_URL - remote file, defaults to DA's map_org_names.yaml
+// MAP_ORG_NAMES_SHA256 - optional expected SHA-256 sum of the YAML file
+func getMapOrgNamesYAMLBody() ([]byte, string) {
+	yamlRemotePath := os.Getenv("MAP_ORG_NAMES_URL")
+	if yamlRemotePath == "" {
+		yamlRemotePath = "https://github.com/LF-Engineering/dev-analytics-affiliation/raw/master/map_org_names.yaml"
 	}
-	return
+	return readSource(os.Getenv("MAP_ORG_NAMES_PATH"), yamlRemotePath, os.Getenv("MAP_ORG_NAMES_SHA256"))
 }
 
+// main - commands: import (default) - import devstats affiliations into Sorting Hat,
+// export - export Sorting Hat data into devstats github_users.json format,
+// diff - compare devstats affiliations with Sorting Hat enrollments
 func main() {
+	command := "import"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	switch command {
+	case "import", "export", "diff":
+	default:
+		fatalf("unknown command: '%s', allowed: import, export, diff", command)
+	}
+
 	// Connect to MariaDB
 	dsn := getConnectString()
 	db, err := sql.Open("mysql", dsn)
 	fatalOnError(err)
 	defer func() { fatalOnError(db.Close()) }()
 
-	esURL := os.Getenv("ES_URL")
-	if esURL == "" {
-		fatalf("you need to specify ES_URL env variable")
-	}
-	repoAccess := os.Getenv("REPO_ACCESS")
-	if repoAccess == "" {
-		fatalf("you need to specify REPO_ACCESS env variable")
+	foundations := getFoundations()
+	if command == "export" {
+		exportAffs(db, foundations)
+		return
 	}
 
-	// Get all CNCF projects slugs from DA-api repo
-	var cncfSlugs []string
-	cncfSlugs, err = getCNCFSlugs(repoAccess)
-	fatalOnError(err)
-	fmt.Printf("Found %d CNCF projects\n", len(cncfSlugs))
-
-	// Parse github_users.json
-	var users gitHubUsers
-	// Read json data from local file falling back to remote file
-	data := getAffiliationsJSONBody()
-	fatalOnError(json.Unmarshal(data, &users))
+	// github_users.json is streamed from local file falling back to remote file
+	users := getUserStream()
 
 	// Parse companies.yaml
 	var acqs allAcquisitions
 	// Read yaml data from local file falling back to remote file
-	data = getAcquisitionsYAMLBody()
-	fatalOnError(yaml.Unmarshal(data, &acqs))
+	data, source := getAcquisitionsYAMLBody()
+	parseYAMLSource(data, source, &acqs)
 
 	// Parse DA's map_org_names.yaml
 	var mapOrgNames allMappings
 	// Read yaml data from local file falling back to remote file
-	data = getMapOrgNamesYAMLBody()
-	fatalOnError(yaml.Unmarshal(data, &mapOrgNames))
+	data, source = getMapOrgNamesYAMLBody()
+	parseYAMLSource(data, source, &mapOrgNames)
+
+	if command == "diff" {
+		diffAffs(db, users, &acqs, &mapOrgNames, foundations)
+		return
+	}
+
+	// Bot rules are read and validated before any DB writes, SKIP_BOTS disables bots detection
+	var botRules *botConfig
+	if os.Getenv("SKIP_BOTS") == "" {
+		botRules = getBotRules()
+	}
+
+	resolver := getCachedResolver(getProjectResolver(db, os.Getenv("DBG") != ""))
+
+	// Get all foundations projects slugs
+	slugs := getFoundationsSlugs(getSlugProvider(), foundations)
+	fmt.Printf("Found %d projects in %d foundations\n", len(slugs), len(foundations))
 
 	// Import affiliations
-	importAffs(db, &users, &acqs, &mapOrgNames, esURL, cncfSlugs)
+	importAffs(db, users, &acqs, &mapOrgNames, resolver, foundations, slugs, botRules)
 }
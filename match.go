@@ -0,0 +1,592 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Match kinds, higher value means more specific match
+const (
+	cMatchNameMulti  = 1
+	cMatchNameSingle = 2
+	cMatchUsername   = 3
+	cMatchEmail      = 4
+)
+
+// Conflict policies
+const (
+	cPolicyAll      = "all"
+	cPolicySkip     = "skip"
+	cPolicyFirst    = "first"
+	cPolicySpecific = "specific"
+)
+
+// Matching strategies, each has a configurable weight
+const (
+	cStrategyEmail          = "email"
+	cStrategyUsernameGitHub = "username_github"
+	cStrategyUsernameGit    = "username_git"
+	cStrategyUsernameOther  = "username_other"
+	cStrategyNameSingle     = "name_single"
+	cStrategyNameMulti      = "name_multi"
+)
+
+var matchStrategies = []string{
+	cStrategyEmail,
+	cStrategyUsernameGitHub,
+	cStrategyUsernameGit,
+	cStrategyUsernameOther,
+	cStrategyNameSingle,
+	cStrategyNameMulti,
+}
+
+var strategyKinds = map[string]int{
+	cStrategyEmail:          cMatchEmail,
+	cStrategyUsernameGitHub: cMatchUsername,
+	cStrategyUsernameGit:    cMatchUsername,
+	cStrategyUsernameOther:  cMatchUsername,
+	cStrategyNameSingle:     cMatchNameSingle,
+	cStrategyNameMulti:      cMatchNameMulti,
+}
+
+var matchKindNames = map[int]string{
+	cMatchNameMulti:  "name (multiple hits)",
+	cMatchNameSingle: "name (single hit)",
+	cMatchUsername:   "username",
+	cMatchEmail:      "email",
+}
+
+// userMatch - Sorting Hat UUIDs matched for a single devstats user
+// uuids maps UUID to the most specific match kind that hit it, scores maps UUID to its match score
+// order lists matched UUIDs in the order they were found (user's emails, then logins, then name)
+type userMatch struct {
+	user   gitHubUser
+	uuids  map[string]int
+	scores map[string]float64
+	order  []string
+}
+
+// uuidCandidate - single UUID hit by one or more matching strategies, seq is the order in which it was found
+type uuidCandidate struct {
+	kind       int
+	score      float64
+	strategies []string
+	seq        int
+}
+
+// hasStrategy - checks if candidate was already hit by a given strategy, each strategy is scored once
+func (c *uuidCandidate) hasStrategy(strategy string) bool {
+	for _, s := range c.strategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// identityIndex - Sorting Hat identities indexed by email, username (per matching strategy) and name
+// strict: use raw values as keys, otherwise keys are normalized
+type identityIndex struct {
+	email2uuid    map[string]map[string]struct{}
+	username2uuid map[string]map[string]map[string]struct{}
+	name2uuid     map[string]map[string]struct{}
+	strict        bool
+}
+
+var noreplyRe = regexp.MustCompile(`^(?:\d+\+)?([^@+]+)@users\.noreply\.github\.com$`)
+
+// normalizeKey - Unicode NFKC normalization, case folding, trimming and whitespace collapsing
+// Caser is stateful, so a new one is used for each call
+func normalizeKey(str string) string {
+	return cases.Fold().String(strings.Join(strings.Fields(norm.NFKC.String(str)), " "))
+}
+
+// noreplyLogin - returns GitHub login from noreply email like "123+login@users.noreply.github.com" or "login@users.noreply.github.com"
+func noreplyLogin(email string) string {
+	match := noreplyRe.FindStringSubmatch(email)
+	if len(match) < 2 {
+		return ""
+	}
+	return match[1]
+}
+
+// key - returns index key for a given value
+func (idx *identityIndex) key(str string) string {
+	if idx.strict {
+		return str
+	}
+	return normalizeKey(str)
+}
+
+// matcher - scored devstats user to Sorting Hat UUIDs matcher
+// nameMatch: 0 - do not match using name, 1 - match only when single hit, 2 - match on multiple hits
+// Only UUIDs with score above threshold are matched
+type matcher struct {
+	idx       *identityIndex
+	weights   map[string]float64
+	threshold float64
+	nameMatch int
+	dbg       bool
+}
+
+// addToIndex - adds UUID under a given key, empty keys are not indexed so blank values never match each other
+func addToIndex(m map[string]map[string]struct{}, key, uuid string) {
+	if key == "" {
+		return
+	}
+	_, ok := m[key]
+	if !ok {
+		m[key] = make(map[string]struct{})
+	}
+	m[key][uuid] = struct{}{}
+}
+
+// usernameStrategy - returns username matching strategy for a given identity source
+func usernameStrategy(source string) string {
+	switch source {
+	case cGitHub:
+		return cStrategyUsernameGitHub
+	case cGit:
+		return cStrategyUsernameGit
+	}
+	return cStrategyUsernameOther
+}
+
+// loadIdentities - reads all Sorting Hat identities and indexes them
+// onlyGGHUsername/onlyGGHName: only index usernames/names from git and GitHub sources
+// strict: do not normalize keys and do not parse GitHub noreply emails
+func loadIdentities(db *sql.DB, onlyGGHUsername, onlyGGHName, strict bool) *identityIndex {
+	fmt.Printf("Reading existing identities...\n")
+	rows, err := db.Query("select uuid, email, username, name, source from identities")
+	fatalOnError(err)
+	var (
+		uuid      string
+		pemail    *string
+		pusername *string
+		pname     *string
+		source    string
+	)
+	idx := &identityIndex{
+		email2uuid:    make(map[string]map[string]struct{}),
+		username2uuid: make(map[string]map[string]map[string]struct{}),
+		name2uuid:     make(map[string]map[string]struct{}),
+		strict:        strict,
+	}
+	for _, strategy := range []string{cStrategyUsernameGitHub, cStrategyUsernameGit, cStrategyUsernameOther} {
+		idx.username2uuid[strategy] = make(map[string]map[string]struct{})
+	}
+	for rows.Next() {
+		fatalOnError(rows.Scan(&uuid, &pemail, &pusername, &pname, &source))
+		if pemail != nil {
+			addToIndex(idx.email2uuid, idx.key(*pemail), uuid)
+			if !strict {
+				login := noreplyLogin(idx.key(*pemail))
+				if login != "" {
+					addToIndex(idx.username2uuid[cStrategyUsernameGitHub], login, uuid)
+				}
+			}
+		}
+		if pusername != nil && (!onlyGGHUsername || source == cGit || source == cGitHub) {
+			addToIndex(idx.username2uuid[usernameStrategy(source)], idx.key(*pusername), uuid)
+		}
+		if pname != nil && (!onlyGGHName || source == cGit || source == cGitHub) {
+			addToIndex(idx.name2uuid, idx.key(*pname), uuid)
+		}
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	return idx
+}
+
+// getMatchWeights - MATCH_WEIGHTS='email:1,username_github:1,username_git:1,username_other:1,name_single:1,name_multi:1'
+// All weights default to 1, set strategy weight to 0 to disable it
+func getMatchWeights() map[string]float64 {
+	weights := make(map[string]float64)
+	for _, strategy := range matchStrategies {
+		weights[strategy] = 1.0
+	}
+	sWeights := os.Getenv("MATCH_WEIGHTS")
+	if sWeights == "" {
+		return weights
+	}
+	for _, sWeight := range strings.Split(sWeights, ",") {
+		sWeight = strings.TrimSpace(sWeight)
+		if sWeight == "" {
+			continue
+		}
+		ary := strings.Split(sWeight, ":")
+		if len(ary) != 2 {
+			fatalf("invalid match weight: '%s', expected strategy:weight", sWeight)
+		}
+		strategy := strings.TrimSpace(ary[0])
+		_, ok := weights[strategy]
+		if !ok {
+			fatalf("unknown matching strategy: '%s', allowed: %s", strategy, strings.Join(matchStrategies, ", "))
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(ary[1]), 64)
+		fatalOnError(err)
+		weights[strategy] = weight
+	}
+	return weights
+}
+
+// addCandidates - adds score for all UUIDs hit by a given strategy, keeps the most specific kind per UUID
+func (m *matcher) addCandidates(candidates map[string]*uuidCandidate, hits map[string]struct{}, strategy string) {
+	weight := m.weights[strategy]
+	if weight == 0 {
+		return
+	}
+	kind := strategyKinds[strategy]
+	uuids := []string{}
+	for uuid := range hits {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		candidate, ok := candidates[uuid]
+		if !ok {
+			candidate = &uuidCandidate{seq: len(candidates)}
+			candidates[uuid] = candidate
+		}
+		if candidate.hasStrategy(strategy) {
+			continue
+		}
+		if candidate.kind < kind {
+			candidate.kind = kind
+		}
+		candidate.score += weight
+		candidate.strategies = append(candidate.strategies, strategy)
+	}
+}
+
+// match - returns all UUIDs candidates for a given devstats user and number of name hits
+// All user's emails and current and previous logins are checked
+func (m *matcher) match(user *gitHubUser) (candidates map[string]*uuidCandidate, nameHits int) {
+	candidates = make(map[string]*uuidCandidate)
+	var (
+		uuida map[string]struct{}
+		ok    bool
+	)
+	logins := []string{}
+	for _, login := range user.logins() {
+		logins = append(logins, m.idx.key(login))
+	}
+	for _, email := range user.emails() {
+		email = m.idx.key(email)
+		uuida, ok = m.idx.email2uuid[email]
+		if m.dbg {
+			fmt.Printf("email: %s --> %v/%v\n", email, uuida, ok)
+		}
+		if ok {
+			m.addCandidates(candidates, uuida, cStrategyEmail)
+		}
+		if !m.idx.strict {
+			login := noreplyLogin(email)
+			if login != "" {
+				logins = append(logins, login)
+			}
+		}
+	}
+	checked := make(stringSet)
+	for _, login := range logins {
+		_, ok = checked[login]
+		if ok {
+			continue
+		}
+		checked[login] = struct{}{}
+		for _, strategy := range []string{cStrategyUsernameGitHub, cStrategyUsernameGit, cStrategyUsernameOther} {
+			uuida, ok = m.idx.username2uuid[strategy][login]
+			if m.dbg {
+				fmt.Printf("%s: %s --> %v/%v\n", strategy, login, uuida, ok)
+			}
+			if ok {
+				m.addCandidates(candidates, uuida, strategy)
+			}
+		}
+	}
+	name := m.idx.key(user.Name)
+	if m.nameMatch > 0 && name != "" {
+		uuida, ok = m.idx.name2uuid[name]
+		if m.dbg {
+			fmt.Printf("name: %s --> %v/%v\n", user.Name, uuida, ok)
+		}
+		nameHits = len(uuida)
+		if ok && (m.nameMatch > 1 || (m.nameMatch == 1 && len(uuida) == 1)) {
+			strategy := cStrategyNameSingle
+			if len(uuida) > 1 {
+				strategy = cStrategyNameMulti
+			}
+			m.addCandidates(candidates, uuida, strategy)
+		}
+	}
+	return
+}
+
+// accept - returns user match with UUIDs scored above threshold and the best score found
+func (m *matcher) accept(user *gitHubUser, candidates map[string]*uuidCandidate) (match userMatch, best float64) {
+	match = userMatch{user: *user, uuids: make(map[string]int), scores: make(map[string]float64)}
+	for uuid, candidate := range candidates {
+		if candidate.score > best {
+			best = candidate.score
+		}
+		if candidate.score > m.threshold {
+			match.uuids[uuid] = candidate.kind
+			match.scores[uuid] = candidate.score
+			match.order = append(match.order, uuid)
+		}
+	}
+	sort.Slice(match.order, func(i, j int) bool {
+		return candidates[match.order[i]].seq < candidates[match.order[j]].seq
+	})
+	return
+}
+
+// getConflictPolicy - CONFLICT_POLICY can be: all (default - only report), skip, first, specific
+func getConflictPolicy() string {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("CONFLICT_POLICY")))
+	switch policy {
+	case "":
+		return cPolicyAll
+	case cPolicyAll, cPolicySkip, cPolicyFirst, cPolicySpecific:
+		return policy
+	}
+	fatalf("unknown conflict policy: '%s', allowed: all, skip, first, specific", policy)
+	return ""
+}
+
+// affCompanies - returns sorted, lower case list of companies from devstats affiliation string
+func affCompanies(affs string) string {
+	if affs == "NotFound" || affs == "(Unknown)" || affs == "?" || affs == "-" || affs == "" {
+		return ""
+	}
+	set := make(stringSet)
+	for _, aff := range strings.Split(affs, ", ") {
+		company := strings.ToLower(strings.TrimSpace(strings.Split(aff, " < ")[0]))
+		if company != "" {
+			set[company] = struct{}{}
+		}
+	}
+	companies := []string{}
+	for company := range set {
+		companies = append(companies, company)
+	}
+	sort.Strings(companies)
+	return strings.Join(companies, ", ")
+}
+
+func sortedUUIDs(uuids map[string]int) (ary []string) {
+	for uuid := range uuids {
+		ary = append(ary, uuid)
+	}
+	sort.Strings(ary)
+	return
+}
+
+// resolveConflicts - detects users matching more than maxUUIDs UUIDs and UUIDs claimed by
+// multiple logins with different companies, then applies conflict policy:
+// all - only report conflicts
+// skip - skip users with too many UUIDs, drop conflicting UUIDs from all logins claiming them
+// first - keep only the first maxUUIDs UUIDs (in match order) for users with too many UUIDs,
+// conflicting UUID goes to the first login claiming it
+// specific - keep only the most specific UUIDs for users with too many UUIDs (skip user when still too many),
+// conflicting UUID goes to the login that matched it using the most specific match
+func resolveConflicts(matches []userMatch, policy string, maxUUIDs int, rep *runReport) (res []userMatch) {
+	conflictsTable := rep.table("conflicts", "Matching conflicts", []string{"Type", "Login", "UUIDs", "Details", "Action"})
+	tooMany := 0
+	if maxUUIDs > 0 {
+		for i := range matches {
+			match := &matches[i]
+			nUUIDs := len(match.uuids)
+			if nUUIDs <= maxUUIDs {
+				continue
+			}
+			tooMany++
+			allUUIDs := make(map[string]int)
+			for uuid, kind := range match.uuids {
+				allUUIDs[uuid] = kind
+			}
+			action := "none"
+			switch policy {
+			case cPolicySkip:
+				match.uuids = map[string]int{}
+				action = "user skipped"
+			case cPolicyFirst:
+				kept := make(map[string]int)
+				keptOrder := []string{}
+				for _, uuid := range match.order {
+					kind, ok := match.uuids[uuid]
+					if ok && len(kept) < maxUUIDs {
+						kept[uuid] = kind
+						keptOrder = append(keptOrder, uuid)
+					}
+				}
+				match.uuids = kept
+				action = "kept first matches: " + strings.Join(keptOrder, " ")
+			case cPolicySpecific:
+				best := 0
+				for _, kind := range match.uuids {
+					if kind > best {
+						best = kind
+					}
+				}
+				for uuid, kind := range match.uuids {
+					if kind < best {
+						delete(match.uuids, uuid)
+					}
+				}
+				if len(match.uuids) > maxUUIDs {
+					match.uuids = map[string]int{}
+					action = "user skipped"
+				} else {
+					action = "kept " + matchKindNames[best] + " matches: " + strings.Join(sortedUUIDs(match.uuids), " ")
+				}
+			}
+			rep.addRow(
+				conflictsTable,
+				"too many UUIDs",
+				match.user.Login,
+				strings.Join(sortedUUIDs(allUUIDs), " "),
+				fmt.Sprintf("%d UUIDs matched, limit is %d", nUUIDs, maxUUIDs),
+				action,
+			)
+		}
+	}
+	uuid2matches := make(map[string][]int)
+	for i, match := range matches {
+		for uuid := range match.uuids {
+			uuid2matches[uuid] = append(uuid2matches[uuid], i)
+		}
+	}
+	conflicting := 0
+	for _, uuid := range sortedUUIDsList(uuid2matches) {
+		idxs := uuid2matches[uuid]
+		if len(idxs) < 2 {
+			continue
+		}
+		companies := make(map[string]struct{})
+		logins := []string{}
+		details := []string{}
+		for _, i := range idxs {
+			match := matches[i]
+			companies[affCompanies(match.user.Affiliation)] = struct{}{}
+			logins = append(logins, match.user.Login)
+			details = append(details, fmt.Sprintf("%s: '%s' (%s)", match.user.Login, match.user.Affiliation, matchKindNames[match.uuids[uuid]]))
+		}
+		if len(companies) < 2 {
+			continue
+		}
+		conflicting++
+		action := "none"
+		switch policy {
+		case cPolicySkip:
+			for _, i := range idxs {
+				delete(matches[i].uuids, uuid)
+			}
+			action = "UUID skipped"
+		case cPolicyFirst, cPolicySpecific:
+			winner := idxs[0]
+			if policy == cPolicySpecific {
+				for _, i := range idxs[1:] {
+					if matches[i].uuids[uuid] > matches[winner].uuids[uuid] {
+						winner = i
+					}
+				}
+			}
+			for _, i := range idxs {
+				if i != winner {
+					delete(matches[i].uuids, uuid)
+				}
+			}
+			action = "UUID kept for " + matches[winner].user.Login
+		}
+		rep.addRow(conflictsTable, "conflicting logins", strings.Join(logins, " "), uuid, strings.Join(details, "; "), action)
+	}
+	for _, match := range matches {
+		if len(match.uuids) > 0 {
+			res = append(res, match)
+		}
+	}
+	rep.addSummary("Users with too many UUIDs", tooMany)
+	rep.addSummary("UUIDs with conflicting logins", conflicting)
+	fmt.Printf("Conflicts (policy: %s): %d users with too many UUIDs, %d UUIDs with conflicting logins, %d/%d matched users left\n", policy, tooMany, conflicting, len(res), len(matches))
+	return
+}
+
+func sortedUUIDsList(m map[string][]int) (ary []string) {
+	for uuid := range m {
+		ary = append(ary, uuid)
+	}
+	sort.Strings(ary)
+	return
+}
+
+// matchUsers - matches streamed devstats users to Sorting Hat UUIDs and resolves conflicts, returns number of all users too
+// Only matched users are kept in memory, unmatched users and candidates scores are only added to report
+// when detailed is set (report is going to be written), otherwise they are only counted
+func matchUsers(idx *identityIndex, users *userStream, nameMatch int, dbg, detailed bool, rep *runReport) (matches []userMatch, nUnmatched, nUsers int) {
+	unmatchedTable := rep.table("unmatched_users", "Unmatched devstats users", []string{"Login", "Email", "Name", "Affiliation", "Reason"})
+	matchThreshold := 0.0
+	sMatchThreshold := os.Getenv("MATCH_THRESHOLD")
+	if sMatchThreshold != "" {
+		var e error
+		matchThreshold, e = strconv.ParseFloat(sMatchThreshold, 64)
+		fatalOnError(e)
+	}
+	mt := &matcher{idx: idx, weights: getMatchWeights(), threshold: matchThreshold, nameMatch: nameMatch, dbg: dbg}
+	scoresTable := rep.table("match_scores", "Match scores", []string{"Login", "UUID", "Score", "Strategies", "Accepted"})
+	fmt.Printf("Matching JSON...\n")
+	nUsers = users.each(func(user *gitHubUser) {
+		// Email decode ! --> @, each of comma separated emails separately
+		emails := []string{}
+		for _, email := range user.emails() {
+			emails = append(emails, strings.ToLower(emailDecode(email)))
+		}
+		user.Email = strings.Join(emails, ",")
+		candidates, nameHits := mt.match(user)
+		match, best := mt.accept(user, candidates)
+		if detailed {
+			for uuid, candidate := range candidates {
+				_, accepted := match.uuids[uuid]
+				rep.addRow(
+					scoresTable,
+					user.Login,
+					uuid,
+					strconv.FormatFloat(candidate.score, 'f', -1, 64),
+					strings.Join(candidate.strategies, " "),
+					strconv.FormatBool(accepted),
+				)
+			}
+		}
+		if len(match.uuids) == 0 {
+			nUnmatched++
+			if detailed {
+				reason := unmatchedReason(user, nameMatch, nameHits)
+				if len(candidates) > 0 {
+					reason = fmt.Sprintf("best score %g not above threshold %g", best, matchThreshold)
+				}
+				rep.addRow(unmatchedTable, user.Login, user.Email, user.Name, user.Affiliation, reason)
+			}
+			return
+		}
+		matches = append(matches, match)
+	})
+	rep.sortTable(scoresTable, 0, 1)
+	maxUserUUIDs := 0
+	sMaxUserUUIDs := os.Getenv("MAX_USER_UUIDS")
+	if sMaxUserUUIDs != "" {
+		var e error
+		maxUserUUIDs, e = strconv.Atoi(sMaxUserUUIDs)
+		fatalOnError(e)
+	}
+	rep.sortTable(unmatchedTable, 0, 1)
+	matches = resolveConflicts(matches, getConflictPolicy(), maxUserUUIDs, rep)
+	return
+}
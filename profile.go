@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Profile fields that can be updated from devstats data
+const (
+	cProfileCountry   = "country"
+	cProfileGender    = "gender"
+	cProfileName      = "name"
+	cProfileTz        = "tz"
+	cProfileTzCountry = "tz_country"
+)
+
+// Profile update policies
+const (
+	cProfileOverwrite = "overwrite"
+	cProfileFill      = "fill"
+)
+
+// profileUpdater - updates selected Sorting Hat profile fields from devstats data
+// fields - which fields can be updated, overwrite - replace existing values or only fill empty ones
+// minSexProb - minimum devstats sex_prob required to write gender
+// tzTable - extension table storing profiles timezones, tz2country - unambiguous timezone -> country code mapping
+// lowSexProb - number of gender updates skipped because of too low (or missing) sex_prob
+type profileUpdater struct {
+	fields     map[string]bool
+	overwrite  bool
+	minSexProb float64
+	lowSexProb int
+	countries  *countryNormalizer
+	tzTable    string
+	tz2country map[string]string
+	rep        *runReport
+	changes    *reportTable
+}
+
+// profileChange - single profile column change
+type profileChange struct {
+	column string
+	old    *string
+	new    string
+}
+
+// getProfileUpdater - returns nil when no profile fields should be updated
+// PROFILE_FIELDS is a comma separated list of: country, gender, name, tz, tz_country or none, defaults to "country,gender"
+// NO_PROFILE_UPDATE=1 is the same as PROFILE_FIELDS=none
+// PROFILE_POLICY can be: overwrite (default) or fill (only set empty fields)
+// MIN_SEX_PROB - minimum sex_prob (0-1) required to write gender, defaults to 0 (no minimum)
+// PROFILE_TZ_TABLE - timezones extension table, defaults to profiles_tz
+// TZ_ZONES_FILE - tzdata zones file used to derive country from timezone, defaults to /usr/share/zoneinfo/zone.tab
+func getProfileUpdater(db *sql.DB, countries *countryNormalizer, rep *runReport) *profileUpdater {
+	if os.Getenv("NO_PROFILE_UPDATE") != "" {
+		return nil
+	}
+	p := &profileUpdater{
+		fields:    make(map[string]bool),
+		overwrite: true,
+		countries: countries,
+		rep:       rep,
+	}
+	sFields := os.Getenv("PROFILE_FIELDS")
+	if sFields == "" {
+		sFields = cProfileCountry + "," + cProfileGender
+	}
+	for _, field := range strings.Split(sFields, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch field {
+		case "":
+			continue
+		case "none":
+			return nil
+		case cProfileCountry, cProfileGender, cProfileName, cProfileTz, cProfileTzCountry:
+			p.fields[field] = true
+		default:
+			fatalf("unknown profile field: '%s', allowed: country, gender, name, tz, tz_country, none", field)
+		}
+	}
+	if len(p.fields) == 0 {
+		return nil
+	}
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("PROFILE_POLICY")))
+	switch policy {
+	case "", cProfileOverwrite:
+	case cProfileFill:
+		p.overwrite = false
+	default:
+		fatalf("unknown profile policy: '%s', allowed: overwrite, fill", policy)
+	}
+	sMinSexProb := os.Getenv("MIN_SEX_PROB")
+	if sMinSexProb != "" {
+		var err error
+		p.minSexProb, err = strconv.ParseFloat(sMinSexProb, 64)
+		fatalOnError(err)
+	}
+	if p.fields[cProfileTz] {
+		p.tzTable = os.Getenv("PROFILE_TZ_TABLE")
+		if p.tzTable == "" {
+			p.tzTable = "profiles_tz"
+		}
+		_, err := db.Exec(
+			"create table if not exists " + p.tzTable + " (" +
+				"uuid varchar(128) not null primary key, " +
+				"tz varchar(64) not null, " +
+				"last_modified datetime(6) default null" +
+				") default charset=utf8mb4",
+		)
+		fatalOnError(err)
+	}
+	if p.fields[cProfileTzCountry] {
+		path := os.Getenv("TZ_ZONES_FILE")
+		if path == "" {
+			path = "/usr/share/zoneinfo/zone.tab"
+		}
+		var err error
+		p.tz2country, err = readTzCountries(path)
+		fatalOnError(err)
+		fmt.Printf("Read %d unambiguous timezone countries from %s\n", len(p.tz2country), path)
+	}
+	p.changes = rep.table("profile_changes", "Profile changes", []string{"UUID", "Login", "Field", "Old", "New"})
+	return p
+}
+
+// readTzCountries - reads tzdata zone.tab file: country code, coordinates, timezone - one country per timezone
+// zone1970.tab merges timezones of multiple countries (and drops merged ones), such ambiguous lines are skipped
+func readTzCountries(path string) (tz2country map[string]string, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	tz2country = make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ary := strings.Split(line, "\t")
+		if len(ary) < 3 {
+			err = fmt.Errorf("%s: invalid zones line: '%s'", path, line)
+			return
+		}
+		if strings.Contains(ary[0], ",") {
+			continue
+		}
+		tz2country[ary[2]] = strings.ToLower(ary[0])
+	}
+	return
+}
+
+// tzCountry - returns country code derived from timezone, empty when unknown or ambiguous
+func (p *profileUpdater) tzCountry(tz *string) string {
+	if tz == nil {
+		return ""
+	}
+	return p.tz2country[strings.TrimSpace(*tz)]
+}
+
+// updateTz - stores user timezone in timezones extension table, returns true when it was changed
+func (p *profileUpdater) updateTz(db *sql.DB, uuid string, user *gitHubUser) bool {
+	if user.Tz == nil || strings.TrimSpace(*user.Tz) == "" {
+		return false
+	}
+	tz := strings.TrimSpace(*user.Tz)
+	var old *string
+	rows, err := db.Query("select tz from "+p.tzTable+" where uuid = ?", uuid)
+	fatalOnError(err)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&old))
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	changes := p.set(nil, "tz", old, tz)
+	if len(changes) == 0 {
+		return false
+	}
+	_, err = db.Exec(
+		"insert into "+p.tzTable+"(uuid, tz, last_modified) values(?, ?, now()) "+
+			"on duplicate key update tz = values(tz), last_modified = now()",
+		uuid, tz,
+	)
+	fatalOnError(err)
+	p.addChanges(uuid, user, changes)
+	return true
+}
+
+// addChanges - adds profile changes to report
+func (p *profileUpdater) addChanges(uuid string, user *gitHubUser, changes []profileChange) {
+	for _, change := range changes {
+		old := ""
+		if change.old != nil {
+			old = *change.old
+		}
+		p.rep.addRow(p.changes, uuid, user.Login, change.column, old, change.new)
+	}
+}
+
+// set - adds column change when field can be updated (depending on policy) and new value differs from the current one
+func (p *profileUpdater) set(changes []profileChange, column string, old *string, value string) []profileChange {
+	if old != nil && *old != "" && !p.overwrite {
+		return changes
+	}
+	if old != nil && *old == value {
+		return changes
+	}
+	return append(changes, profileChange{column: column, old: old, new: value})
+}
+
+// update - updates profile fields using devstats user data, returns true when profile was changed
+func (p *profileUpdater) update(db *sql.DB, uuid string, user *gitHubUser) bool {
+	var (
+		name, gender, genderAcc, countryCode *string
+		found                                bool
+	)
+	rows, err := db.Query("select name, gender, cast(gender_acc as char), country_code from profiles where uuid = ?", uuid)
+	fatalOnError(err)
+	for rows.Next() {
+		fatalOnError(rows.Scan(&name, &gender, &genderAcc, &countryCode))
+		found = true
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	if !found {
+		return false
+	}
+	tzUpdated := false
+	if p.fields[cProfileTz] {
+		tzUpdated = p.updateTz(db, uuid, user)
+	}
+	var changes []profileChange
+	// Names are curated in Sorting Hat, so only empty ones are filled, regardless of policy
+	if p.fields[cProfileName] && strings.TrimSpace(user.Name) != "" && (name == nil || strings.TrimSpace(*name) == "") {
+		changes = append(changes, profileChange{column: "name", old: name, new: strings.TrimSpace(user.Name)})
+	}
+	lowSexProb := p.minSexProb > 0 && (user.SexProb == nil || *user.SexProb < p.minSexProb)
+	if p.fields[cProfileGender] && user.Sex != nil && (*user.Sex == "m" || *user.Sex == "f") {
+		if lowSexProb {
+			p.lowSexProb++
+		} else {
+			newGender := "male"
+			if *user.Sex == "f" {
+				newGender = "female"
+			}
+			changes = p.set(changes, "gender", gender, newGender)
+		}
+	}
+	// Gender accuracy is updated whenever devstats has sex_prob (unless it is below MIN_SEX_PROB)
+	if p.fields[cProfileGender] && user.SexProb != nil && !lowSexProb {
+		acc := strconv.Itoa(int(*user.SexProb * 100.0))
+		if genderAcc == nil || *genderAcc != acc {
+			changes = append(changes, profileChange{column: "gender_acc", old: genderAcc, new: acc})
+		}
+	}
+	country := ""
+	if p.fields[cProfileCountry] && user.CountryID != nil && *user.CountryID != "" {
+		country = *user.CountryID
+	} else if p.fields[cProfileTzCountry] && (user.CountryID == nil || *user.CountryID == "") && (countryCode == nil || *countryCode == "") {
+		// Timezone derived country is only a fallback, so only empty country is filled, regardless of policy
+		country = p.tzCountry(user.Tz)
+	}
+	if country != "" {
+		code, ok := p.countries.normalize(db, country)
+		if ok {
+			changes = p.set(changes, "country_code", countryCode, code)
+		}
+	}
+	if len(changes) == 0 {
+		return tzUpdated
+	}
+	var (
+		cols []string
+		args []interface{}
+	)
+	for _, change := range changes {
+		cols = append(cols, change.column+" = ?")
+		args = append(args, change.new)
+	}
+	query := "update profiles set " + strings.Join(cols, ", ") + " where uuid = ?"
+	args = append(args, uuid)
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		fmt.Printf("%s %+v\n", query, args)
+	}
+	fatalOnError(err)
+	count, err := res.RowsAffected()
+	fatalOnError(err)
+	p.addChanges(uuid, user, changes)
+	return count > 0 || tzUpdated
+}
+
+// report - prints and reports profile updates skipped by updater settings
+func (p *profileUpdater) report() {
+	if p.minSexProb > 0 {
+		fmt.Printf("Skipped %d gender updates with sex_prob below %g\n", p.lowSexProb, p.minSexProb)
+		p.rep.addSummary("Gender updates below minimum sex_prob", p.lowSexProb)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// projectResolver - decides which project slugs given UUIDs contributed to
+// Returns map uuid -> project slug -> activity window (zero dates when resolver cannot tell)
+// and slugs that could not be resolved (their UUIDs are missing from the returned map)
+type projectResolver interface {
+	name() string
+	uuidsProjects(slugs []string, uuids map[string]struct{}) (map[string]map[string]projectActivity, stringSet)
+}
+
+// projectActivity - first and last contribution dates of a given UUID in a given project
+type projectActivity struct {
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// merge - extends activity window to cover other activity window
+func (a projectActivity) merge(other projectActivity) projectActivity {
+	if !other.First.IsZero() && (a.First.IsZero() || other.First.Before(a.First)) {
+		a.First = other.First
+	}
+	if !other.Last.IsZero() && (a.Last.IsZero() || other.Last.After(a.Last)) {
+		a.Last = other.Last
+	}
+	return a
+}
+
+// addActivity - adds or merges UUID activity in a given project
+func addActivity(m map[string]map[string]projectActivity, uuid, slug string, act projectActivity) {
+	_, ok := m[uuid]
+	if !ok {
+		m[uuid] = make(map[string]projectActivity)
+	}
+	prev, ok := m[uuid][slug]
+	if ok {
+		act = prev.merge(act)
+	}
+	m[uuid][slug] = act
+}
+
+// parseESDate - parses ES date returned as a string or as epoch milliseconds, returns zero time for unknown values
+func parseESDate(value interface{}) time.Time {
+	switch v := value.(type) {
+	case string:
+		for _, format := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.000Z0700", "2006-01-02T15:04:05Z0700"} {
+			t, err := time.Parse(format, v)
+			if err == nil {
+				return t.UTC()
+			}
+		}
+	case float64:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)).UTC()
+	}
+	return time.Time{}
+}
+
+// esDataSource - data source name used in ES index template and its UUID fields
+type esDataSource struct {
+	name   string
+	fields []string
+}
+
+// esIndexConfig - ES index template and data sources used to find project contributors
+// Template can use {slug} (project slug with "/" replaced by "-") and {source} placeholders
+// dateField is used to find first and last contribution dates
+type esIndexConfig struct {
+	template  string
+	sources   []esDataSource
+	dateField string
+}
+
+// esTarget - single index pattern and UUID field to query for a given project slug
+type esTarget struct {
+	slug    string
+	pattern string
+	field   string
+}
+
+// esSQLResolver - uses ES SQL API to find contributors in project indices
+type esSQLResolver struct {
+	es  *esClient
+	cfg *esIndexConfig
+	dbg bool
+}
+
+// esSearchResolver - uses plain ES _search API with terms aggregation to find contributors in project indices
+type esSearchResolver struct {
+	es  *esClient
+	cfg *esIndexConfig
+	dbg bool
+}
+
+// fileResolver - uses static YAML/JSON file mapping uuid to a list of project slugs
+type fileResolver struct {
+	path string
+}
+
+// shResolver - uses only Sorting Hat data: project slugs from existing enrollments
+type shResolver struct {
+	db *sql.DB
+}
+
+// getProjectResolver - PROJECT_RESOLVER can be: sql (default), search, file, sh
+func getProjectResolver(db *sql.DB, dbg bool) projectResolver {
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("PROJECT_RESOLVER")))
+	switch kind {
+	case "", "sql", "search":
+		esURL := os.Getenv("ES_URL")
+		if esURL == "" {
+			fatalf("you need to specify ES_URL env variable")
+		}
+		cfg := getESIndexConfig()
+		if kind == "search" {
+			return &esSearchResolver{es: newESClient(esURL), cfg: cfg, dbg: dbg}
+		}
+		return &esSQLResolver{es: newESClient(esURL), cfg: cfg, dbg: dbg}
+	case "file":
+		path := os.Getenv("PROJECT_RESOLVER_FILE")
+		if path == "" {
+			fatalf("you need to specify PROJECT_RESOLVER_FILE env variable when using file project resolver")
+		}
+		return &fileResolver{path: path}
+	case "sh":
+		return &shResolver{db: db}
+	}
+	fatalf("unknown project resolver: '%s', allowed: sql, search, file, sh", kind)
+	return nil
+}
+
+// getESIndexConfig - ES_INDEX_TEMPLATE defaults to "sds-{slug}-{source}*,-*-for-merge,-*-raw"
+// ES_DATE_FIELD defaults to "grimoire_creation_date"
+// ES_DATA_SOURCES is a comma separated list of source:field1;field2, fields default to author_uuid
+// ES_DATA_SOURCES defaults to "git:author_uuid"
+func getESIndexConfig() *esIndexConfig {
+	cfg := &esIndexConfig{template: os.Getenv("ES_INDEX_TEMPLATE"), dateField: os.Getenv("ES_DATE_FIELD")}
+	if cfg.template == "" {
+		cfg.template = "sds-{slug}-{source}*,-*-for-merge,-*-raw"
+	}
+	if cfg.dateField == "" {
+		cfg.dateField = "grimoire_creation_date"
+	}
+	sSources := os.Getenv("ES_DATA_SOURCES")
+	if sSources == "" {
+		sSources = "git:author_uuid"
+	}
+	for _, sSource := range strings.Split(sSources, ",") {
+		sSource = strings.TrimSpace(sSource)
+		if sSource == "" {
+			continue
+		}
+		ary := strings.Split(sSource, ":")
+		source := esDataSource{name: strings.TrimSpace(ary[0])}
+		if len(ary) > 1 {
+			for _, field := range strings.Split(ary[1], ";") {
+				field = strings.TrimSpace(field)
+				if field != "" {
+					source.fields = append(source.fields, field)
+				}
+			}
+		}
+		if len(source.fields) == 0 {
+			source.fields = []string{"author_uuid"}
+		}
+		cfg.sources = append(cfg.sources, source)
+	}
+	if len(cfg.sources) == 0 {
+		fatalf("no ES data sources specified")
+	}
+	return cfg
+}
+
+// key - returns configuration key, projects cache is rebuilt when it changes
+func (c *esIndexConfig) key() string {
+	sources := []string{}
+	for _, source := range c.sources {
+		sources = append(sources, source.name+":"+strings.Join(source.fields, ";"))
+	}
+	return c.template + "|" + c.dateField + "|" + strings.Join(sources, ",")
+}
+
+// pattern - ES index pattern for a given project slug and data source
+func (c *esIndexConfig) pattern(slug, source string) string {
+	pattern := strings.Replace(c.template, "{slug}", strings.Replace(slug, "/", "-", -1), -1)
+	return strings.Replace(pattern, "{source}", source, -1)
+}
+
+// targets - returns all index patterns and UUID fields to query for given project slugs
+func (c *esIndexConfig) targets(slugs []string) (targets []esTarget) {
+	for _, slug := range slugs {
+		for _, source := range c.sources {
+			pattern := c.pattern(slug, source.name)
+			for _, field := range source.fields {
+				targets = append(targets, esTarget{slug: slug, pattern: pattern, field: field})
+			}
+		}
+	}
+	return
+}
+
+// uuidPacks - splits UUIDs set into packs of at most packSize UUIDs
+func uuidPacks(uuids map[string]struct{}, packSize int) (packs [][]string) {
+	uuidsAry := []string{}
+	for uuid := range uuids {
+		uuidsAry = append(uuidsAry, uuid)
+	}
+	nUUIDs := len(uuidsAry)
+	for from := 0; from < nUUIDs; from += packSize {
+		to := from + packSize
+		if to > nUUIDs {
+			to = nUUIDs
+		}
+		packs = append(packs, uuidsAry[from:to])
+	}
+	return
+}
+
+// processTargets - calls process for each ES target and each UUIDs pack using multiple threads
+// process returns UUIDs found in a given target with their activity, results are merged into uuid -> slug -> activity map
+// Set ES_FAIL_POLICY=fail to exit when any target could not be resolved, default is to continue and return failed slugs
+func processTargets(targets []esTarget, packs [][]string, process func(target esTarget, pack []string) (map[string]projectActivity, error)) (m map[string]map[string]projectActivity, failed stringSet) {
+	m = make(map[string]map[string]projectActivity)
+	thrN := runtime.NumCPU()
+	runtime.GOMAXPROCS(thrN)
+	thrN /= 4
+	if thrN < 1 {
+		thrN = 1
+	}
+	failPolicy := strings.ToLower(strings.TrimSpace(os.Getenv("ES_FAIL_POLICY")))
+	if failPolicy != "" && failPolicy != "fail" && failPolicy != "continue" {
+		fatalf("unknown ES fail policy: '%s', allowed: fail, continue", failPolicy)
+	}
+	fmt.Printf("UUIDs processing in %d packs\n", len(packs))
+	failed = make(stringSet)
+	var mMtx *sync.Mutex
+	if thrN > 1 {
+		mMtx = &sync.Mutex{}
+	}
+	processTarget := func(target esTarget, pack []string) (err error) {
+		var slugUUIDs map[string]projectActivity
+		slugUUIDs, err = process(target, pack)
+		if err != nil {
+			return
+		}
+		if mMtx != nil {
+			mMtx.Lock()
+			defer mMtx.Unlock()
+		}
+		for uuid, act := range slugUUIDs {
+			addActivity(m, uuid, target.slug, act)
+		}
+		return
+	}
+	nUUIDs := 0
+	for _, pack := range packs {
+		nUUIDs += len(pack)
+	}
+	fmt.Printf("Using %d threads to process %d project indices and %d UUIDs\n", thrN, len(targets), nUUIDs)
+	if thrN > 1 {
+		ch := make(chan error)
+		nThreads := 0
+		for _, target := range targets {
+			for _, pack := range packs {
+				go func(ch chan error, target esTarget, pack []string) {
+					err := processTarget(target, pack)
+					if err != nil {
+						mMtx.Lock()
+						failed[target.slug] = struct{}{}
+						mMtx.Unlock()
+						err = errors.Wrap(err, "processTarget: "+target.slug+" "+target.pattern+" "+target.field)
+					}
+					ch <- err
+				}(ch, target, pack)
+				nThreads++
+				if nThreads == thrN {
+					err := <-ch
+					if err != nil {
+						fmt.Printf("%+v\n", err)
+					}
+					nThreads--
+				}
+			}
+		}
+		for nThreads > 0 {
+			err := <-ch
+			if err != nil {
+				fmt.Printf("%+v\n", err)
+			}
+			nThreads--
+		}
+	} else {
+		for _, target := range targets {
+			for _, pack := range packs {
+				err := processTarget(target, pack)
+				if err != nil {
+					failed[target.slug] = struct{}{}
+					fmt.Printf("%+v\n", errors.Wrap(err, "processTarget: "+target.slug+" "+target.pattern+" "+target.field))
+				}
+			}
+		}
+	}
+	if len(failed) > 0 {
+		slugs := []string{}
+		for slug := range failed {
+			slugs = append(slugs, slug)
+		}
+		sort.Strings(slugs)
+		fmt.Printf("Could not resolve %d projects: %s\n", len(slugs), strings.Join(slugs, ", "))
+		if failPolicy == "fail" {
+			fatalf("could not resolve %d projects using ES: %s", len(slugs), strings.Join(slugs, ", "))
+		}
+	}
+	return
+}
+
+func (r *esSQLResolver) name() string {
+	return "ES SQL"
+}
+
+// esSQLParam - ES SQL query parameter
+type esSQLParam struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// esSQLQuery - ES SQL query with parameters
+type esSQLQuery struct {
+	Query     string       `json:"query"`
+	Params    []esSQLParam `json:"params,omitempty"`
+	FetchSize int          `json:"fetch_size,omitempty"`
+}
+
+// esSQLCursor - ES SQL next page or close cursor request
+type esSQLCursor struct {
+	Cursor string `json:"cursor"`
+}
+
+// getESChunkSize - ES_CHUNK_SIZE specifies how many UUIDs are queried at once, defaults to 65535
+func getESChunkSize() int {
+	sChunkSize := os.Getenv("ES_CHUNK_SIZE")
+	if sChunkSize == "" {
+		return 0xffff
+	}
+	chunkSize, err := strconv.Atoi(sChunkSize)
+	fatalOnError(err)
+	if chunkSize < 1 {
+		fatalf("ES chunk size must be positive, got %d", chunkSize)
+	}
+	return chunkSize
+}
+
+func (r *esSQLResolver) uuidsProjects(slugs []string, uuids map[string]struct{}) (map[string]map[string]projectActivity, stringSet) {
+	fetchSize := 20000
+	quote := func(ident string) string {
+		return `"` + strings.Replace(ident, `"`, `""`, -1) + `"`
+	}
+	process := func(target esTarget, pack []string) (slugUUIDs map[string]projectActivity, err error) {
+		if r.dbg {
+			fmt.Printf("Processing: %s <--> %s (%s)\n", target.slug, target.pattern, target.field)
+		}
+		slugUUIDs = make(map[string]projectActivity)
+		field := quote(target.field)
+		dateField := quote(r.cfg.dateField)
+		query := esSQLQuery{
+			Query: "select " + field + ", min(" + dateField + "), max(" + dateField + ") from " + quote(target.pattern) +
+				" where " + field + " in (" + strings.Repeat("?,", len(pack)-1) + "?) group by " + field,
+			FetchSize: fetchSize,
+		}
+		for _, uuid := range pack {
+			query.Params = append(query.Params, esSQLParam{Type: "keyword", Value: uuid})
+		}
+		var data []byte
+		data, err = json.Marshal(query)
+		if err != nil {
+			return
+		}
+		type uuidsResult struct {
+			Cursor string          `json:"cursor"`
+			Rows   [][]interface{} `json:"rows"`
+		}
+		var (
+			result uuidsResult
+			body   []byte
+			cursor string
+		)
+		// Always close the cursor, even when some page failed
+		defer func() {
+			if cursor == "" {
+				return
+			}
+			data, _ := json.Marshal(esSQLCursor{Cursor: cursor})
+			_, closeErr := r.es.request("POST", "/_sql/close", string(data))
+			if closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}()
+		body, err = r.es.request("POST", "/_sql?format=json", string(data))
+		for err == nil {
+			err = json.Unmarshal(body, &result)
+			if err != nil {
+				err = fmt.Errorf("Unmarshal error: %+v", err)
+				return
+			}
+			cursor = result.Cursor
+			for _, row := range result.Rows {
+				if len(row) < 3 {
+					continue
+				}
+				uuid, _ := row[0].(string)
+				if uuid != "" {
+					slugUUIDs[uuid] = projectActivity{First: parseESDate(row[1]), Last: parseESDate(row[2])}
+				}
+			}
+			if cursor == "" || len(result.Rows) == 0 {
+				return
+			}
+			result = uuidsResult{}
+			data, _ = json.Marshal(esSQLCursor{Cursor: cursor})
+			body, err = r.es.request("POST", "/_sql?format=json", string(data))
+		}
+		return
+	}
+	return processTargets(r.cfg.targets(slugs), uuidPacks(uuids, getESChunkSize()), process)
+}
+
+func (r *esSearchResolver) name() string {
+	return "ES search"
+}
+
+func (r *esSearchResolver) uuidsProjects(slugs []string, uuids map[string]struct{}) (map[string]map[string]projectActivity, stringSet) {
+	process := func(target esTarget, pack []string) (slugUUIDs map[string]projectActivity, err error) {
+		if r.dbg {
+			fmt.Printf("Processing: %s <--> %s (%s)\n", target.slug, target.pattern, target.field)
+		}
+		slugUUIDs = make(map[string]projectActivity)
+		query := map[string]interface{}{
+			"size": 0,
+			"query": map[string]interface{}{
+				"terms": map[string]interface{}{target.field: pack},
+			},
+			"aggs": map[string]interface{}{
+				"uuids": map[string]interface{}{
+					"terms": map[string]interface{}{"field": target.field, "size": len(pack)},
+					"aggs": map[string]interface{}{
+						"first": map[string]interface{}{"min": map[string]interface{}{"field": r.cfg.dateField}},
+						"last":  map[string]interface{}{"max": map[string]interface{}{"field": r.cfg.dateField}},
+					},
+				},
+			},
+		}
+		var data []byte
+		data, err = json.Marshal(query)
+		if err != nil {
+			return
+		}
+		var body []byte
+		body, err = r.es.request("POST", "/"+target.pattern+"/_search?ignore_unavailable=true&allow_no_indices=true", string(data))
+		if err != nil {
+			return
+		}
+		var result struct {
+			Aggregations struct {
+				UUIDs struct {
+					Buckets []struct {
+						Key   string `json:"key"`
+						First struct {
+							Value interface{} `json:"value"`
+						} `json:"first"`
+						Last struct {
+							Value interface{} `json:"value"`
+						} `json:"last"`
+					} `json:"buckets"`
+				} `json:"uuids"`
+			} `json:"aggregations"`
+		}
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			err = fmt.Errorf("Unmarshal error: %+v", err)
+			return
+		}
+		for _, bucket := range result.Aggregations.UUIDs.Buckets {
+			if bucket.Key != "" {
+				slugUUIDs[bucket.Key] = projectActivity{First: parseESDate(bucket.First.Value), Last: parseESDate(bucket.Last.Value)}
+			}
+		}
+		return
+	}
+	return processTargets(r.cfg.targets(slugs), uuidPacks(uuids, getESChunkSize()), process)
+}
+
+func (r *fileResolver) name() string {
+	return "file " + r.path
+}
+
+// uuidsProjects - file format is a YAML (or JSON) map: uuid: [slug1, slug2, ...], no activity dates are known
+// Only slugs from a given slugs list are returned
+func (r *fileResolver) uuidsProjects(slugs []string, uuids map[string]struct{}) (map[string]map[string]projectActivity, stringSet) {
+	known := make(stringSet)
+	for _, slug := range slugs {
+		known[slug] = struct{}{}
+	}
+	data, err := ioutil.ReadFile(r.path)
+	fatalOnError(err)
+	var uuid2slugs map[string][]string
+	fatalOnError(yaml.Unmarshal(data, &uuid2slugs))
+	m := make(map[string]map[string]projectActivity)
+	for uuid, uuidSlugs := range uuid2slugs {
+		_, ok := uuids[uuid]
+		if !ok {
+			continue
+		}
+		for _, slug := range uuidSlugs {
+			_, ok = known[slug]
+			if ok {
+				addActivity(m, uuid, slug, projectActivity{})
+			}
+		}
+	}
+	fmt.Printf("Read %d uuids projects from %s, %d matching\n", len(uuid2slugs), r.path, len(m))
+	return m, nil
+}
+
+func (r *shResolver) name() string {
+	return "Sorting Hat"
+}
+
+// uuidsProjects - uses project slugs from existing Sorting Hat enrollments, no activity dates are known
+func (r *shResolver) uuidsProjects(slugs []string, uuids map[string]struct{}) (map[string]map[string]projectActivity, stringSet) {
+	m := make(map[string]map[string]projectActivity)
+	if len(slugs) == 0 {
+		return m, nil
+	}
+	args := []interface{}{}
+	for _, slug := range slugs {
+		args = append(args, slug)
+	}
+	query := "select distinct uuid, project_slug from enrollments where project_slug in (" + strings.Repeat("?,", len(slugs)-1) + "?)"
+	rows, err := r.db.Query(query, args...)
+	fatalOnError(err)
+	var uuid, slug string
+	for rows.Next() {
+		fatalOnError(rows.Scan(&uuid, &slug))
+		_, ok := uuids[uuid]
+		if !ok {
+			continue
+		}
+		addActivity(m, uuid, slug, projectActivity{})
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	return m, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// reportItem - single summary metric
+type reportItem struct {
+	name  string
+	value interface{}
+}
+
+// reportTable - single tabular section of the run report
+type reportTable struct {
+	name   string
+	title  string
+	header []string
+	rows   [][]string
+}
+
+// runReport - holds run summary and detail tables, can be written as JSON, CSV or Markdown
+type runReport struct {
+	title   string
+	summary []reportItem
+	tables  []*reportTable
+	mtx     *sync.Mutex
+}
+
+func newRunReport(title string) *runReport {
+	return &runReport{title: title, mtx: &sync.Mutex{}}
+}
+
+// addSummary - adds (or replaces) summary metric
+func (r *runReport) addSummary(name string, value interface{}) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for i, item := range r.summary {
+		if item.name == name {
+			r.summary[i].value = value
+			return
+		}
+	}
+	r.summary = append(r.summary, reportItem{name: name, value: value})
+}
+
+// table - returns existing table or creates a new one with a given header
+func (r *runReport) table(name, title string, header []string) *reportTable {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, t := range r.tables {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &reportTable{name: name, title: title, header: header}
+	r.tables = append(r.tables, t)
+	return t
+}
+
+// addRow - adds row to the report table
+func (r *runReport) addRow(t *reportTable, row ...string) {
+	r.mtx.Lock()
+	t.rows = append(t.rows, row)
+	r.mtx.Unlock()
+}
+
+// sortTable - sorts table rows by given columns
+func (r *runReport) sortTable(t *reportTable, cols ...int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	sort.SliceStable(t.rows, func(i, j int) bool {
+		for _, col := range cols {
+			if t.rows[i][col] != t.rows[j][col] {
+				return t.rows[i][col] < t.rows[j][col]
+			}
+		}
+		return false
+	})
+}
+
+// getReportFormats - REPORT_FORMAT can be a comma separated list of: json, csv, md
+func getReportFormats() []string {
+	return parseReportFormats(os.Getenv("REPORT_FORMAT"))
+}
+
+// parseReportFormats - parses comma separated list of report formats: json, csv, md
+func parseReportFormats(sFormats string) (formats []string) {
+	if sFormats == "" {
+		return
+	}
+	for _, format := range strings.Split(sFormats, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		switch format {
+		case "":
+			continue
+		case "json", "csv", "md":
+		case "markdown":
+			format = "md"
+		default:
+			fatalf("unknown report format: '%s', allowed: json, csv, md", format)
+		}
+		formats = append(formats, format)
+	}
+	return
+}
+
+// writeReport - writes report in all formats requested via REPORT_FORMAT
+// Output files are prefixed by REPORT_PATH which defaults to "report"
+func writeReport(r *runReport) {
+	formats := getReportFormats()
+	if len(formats) == 0 {
+		return
+	}
+	prefix := os.Getenv("REPORT_PATH")
+	if prefix == "" {
+		prefix = "report"
+	}
+	writeReportFiles(r, formats, prefix)
+}
+
+// writeReportFiles - writes report in given formats into files with a given prefix
+func writeReportFiles(r *runReport, formats []string, prefix string) {
+	for _, format := range formats {
+		switch format {
+		case "json":
+			writeJSONReport(r, prefix+".json")
+		case "csv":
+			writeCSVReport(r, prefix)
+		case "md":
+			writeMarkdownReport(r, prefix+".md")
+		}
+	}
+}
+
+func writeJSONReport(r *runReport, fileName string) {
+	summary := make(map[string]interface{})
+	for _, item := range r.summary {
+		summary[item.name] = item.value
+	}
+	tables := make(map[string][]map[string]string)
+	for _, t := range r.tables {
+		rows := []map[string]string{}
+		for _, row := range t.rows {
+			obj := make(map[string]string)
+			for i, col := range t.header {
+				if i < len(row) {
+					obj[col] = row[i]
+				}
+			}
+			rows = append(rows, obj)
+		}
+		tables[t.name] = rows
+	}
+	data, err := json.MarshalIndent(
+		map[string]interface{}{
+			"title":   r.title,
+			"summary": summary,
+			"tables":  tables,
+		},
+		"",
+		"  ",
+	)
+	fatalOnError(err)
+	fatalOnError(ioutil.WriteFile(fileName, data, 0644))
+	fmt.Printf("Written JSON report to %s\n", fileName)
+}
+
+// writeCSVReport - summary goes to prefix.csv, each table goes to prefix_table.csv
+func writeCSVReport(r *runReport, prefix string) {
+	write := func(fileName string, header []string, rows [][]string) {
+		csvFile, err := os.Create(fileName)
+		fatalOnError(err)
+		defer func() { _ = csvFile.Close() }()
+		writer := csv.NewWriter(csvFile)
+		fatalOnError(writer.Write(header))
+		for _, row := range rows {
+			fatalOnError(writer.Write(row))
+		}
+		writer.Flush()
+		fatalOnError(writer.Error())
+		fmt.Printf("Written CSV report to %s\n", fileName)
+	}
+	rows := [][]string{}
+	for _, item := range r.summary {
+		rows = append(rows, []string{item.name, fmt.Sprintf("%v", item.value)})
+	}
+	write(prefix+".csv", []string{"Metric", "Value"}, rows)
+	for _, t := range r.tables {
+		write(prefix+"_"+t.name+".csv", t.header, t.rows)
+	}
+}
+
+func markdownEscape(str string) string {
+	str = strings.Replace(str, "|", "\\|", -1)
+	return strings.Replace(str, "\n", " ", -1)
+}
+
+func writeMarkdownReport(r *runReport, fileName string) {
+	var sb strings.Builder
+	writeTable := func(header []string, rows [][]string) {
+		sb.WriteString("| " + strings.Join(header, " | ") + " |\n")
+		sb.WriteString(strings.Repeat("| --- ", len(header)) + "|\n")
+		for _, row := range rows {
+			cols := []string{}
+			for _, col := range row {
+				cols = append(cols, markdownEscape(col))
+			}
+			sb.WriteString("| " + strings.Join(cols, " | ") + " |\n")
+		}
+	}
+	sb.WriteString("# " + r.title + "\n\n## Summary\n\n")
+	rows := [][]string{}
+	for _, item := range r.summary {
+		rows = append(rows, []string{item.name, fmt.Sprintf("%v", item.value)})
+	}
+	writeTable([]string{"Metric", "Value"}, rows)
+	for _, t := range r.tables {
+		sb.WriteString("\n## " + t.title + "\n\n")
+		if len(t.rows) == 0 {
+			sb.WriteString("None.\n")
+			continue
+		}
+		writeTable(t.header, t.rows)
+	}
+	fatalOnError(ioutil.WriteFile(fileName, []byte(sb.String()), 0644))
+	fmt.Printf("Written Markdown report to %s\n", fileName)
+}
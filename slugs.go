@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// slugProvider - provides list of foundation's project slugs
+type slugProvider interface {
+	name() string
+	slugs(f *foundation) ([]string, error)
+}
+
+// gitSlugProvider - clones DA-api repo into a temporary directory once and reads foundations fixtures
+type gitSlugProvider struct {
+	repoURL string
+	branch  string
+	dir     string
+}
+
+// fixturesSlugProvider - reads fixtures from foundation's local fixtures directory
+type fixturesSlugProvider struct{}
+
+// fileSlugProvider - reads foundation's plain slug list file, one slug per line, lines starting with # are ignored
+type fileSlugProvider struct{}
+
+// esSlugProvider - lists ES indices matching index template and derives foundation's project slugs from their names
+type esSlugProvider struct {
+	es  *esClient
+	cfg *esIndexConfig
+}
+
+// getSlugProvider - SLUG_PROVIDER can be: git (default), fixtures, file, es
+func getSlugProvider() slugProvider {
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("SLUG_PROVIDER")))
+	switch kind {
+	case "", "git":
+		repoAccess := os.Getenv("REPO_ACCESS")
+		if repoAccess == "" {
+			fatalf("you need to specify REPO_ACCESS env variable")
+		}
+		branch := os.Getenv("REPO_BRANCH")
+		if branch == "" {
+			branch = "prod"
+		}
+		return &gitSlugProvider{repoURL: repoAccess, branch: branch}
+	case "fixtures":
+		return &fixturesSlugProvider{}
+	case "file":
+		return &fileSlugProvider{}
+	case "es":
+		esURL := os.Getenv("ES_URL")
+		if esURL == "" {
+			fatalf("you need to specify ES_URL env variable")
+		}
+		return &esSlugProvider{es: newESClient(esURL), cfg: getESIndexConfig()}
+	}
+	fatalf("unknown slug provider: '%s', allowed: git, fixtures, file, es", kind)
+	return nil
+}
+
+// fixturesSlugs - parses native.slug from all fixture YAMLs in a given directory
+func fixturesSlugs(dir string) (slugs []string, err error) {
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		fn := filepath.Join(dir, file.Name())
+		var data []byte
+		data, err = ioutil.ReadFile(fn)
+		if err != nil {
+			return
+		}
+		var fixture fixtureData
+		err = yaml.Unmarshal(data, &fixture)
+		if err != nil {
+			err = errors.Wrap(err, "fixture "+fn)
+			return
+		}
+		if fixture.Native.Slug == "" {
+			err = fmt.Errorf("fixture %s has no slug", fn)
+			return
+		}
+		slugs = append(slugs, fixture.Native.Slug)
+	}
+	return
+}
+
+func (p *gitSlugProvider) name() string {
+	return "git " + p.branch + " branch fixtures"
+}
+
+// clone - clones repo into a temporary directory, only once
+func (p *gitSlugProvider) clone() (err error) {
+	if p.dir != "" {
+		return
+	}
+	var dir string
+	dir, err = ioutil.TempDir("", "json2hat")
+	if err != nil {
+		return
+	}
+	cmd := []string{"git", "clone", "--depth", "1", "--single-branch", "--branch", p.branch, p.repoURL, dir}
+	env := map[string]string{"GIT_TERMINAL_PROMPT": "0"}
+	_, _, err = execCommand(cmd, env, "")
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		// Do not leak repo access token into logs
+		err = fmt.Errorf("git clone of %s branch failed: %s", p.branch, strings.Replace(err.Error(), p.repoURL, "<REPO_ACCESS>", -1))
+		return
+	}
+	p.dir = dir
+	return
+}
+
+// cleanup - removes cloned repo
+func (p *gitSlugProvider) cleanup() {
+	if p.dir != "" {
+		_ = os.RemoveAll(p.dir)
+		p.dir = ""
+	}
+}
+
+func (p *gitSlugProvider) slugs(f *foundation) (slugs []string, err error) {
+	err = p.clone()
+	if err != nil {
+		return
+	}
+	return fixturesSlugs(filepath.Join(p.dir, f.FixturesPath))
+}
+
+func (p *fixturesSlugProvider) name() string {
+	return "local fixtures"
+}
+
+func (p *fixturesSlugProvider) slugs(f *foundation) ([]string, error) {
+	return fixturesSlugs(f.FixturesDir)
+}
+
+func (p *fileSlugProvider) name() string {
+	return "slug list file"
+}
+
+func (p *fileSlugProvider) slugs(f *foundation) (slugs []string, err error) {
+	if f.SlugFile == "" {
+		err = fmt.Errorf("foundation %s has no slug list file configured", f.Name)
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(f.SlugFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		slugs = append(slugs, line)
+	}
+	return
+}
+
+func (p *esSlugProvider) name() string {
+	return "ES indices"
+}
+
+// slugs - lists indices matching template with {slug} set to foundation's slug prefix + "*", then derives slugs from index names
+// Slug prefix "cncf/" is stored as "cncf-" in index names, so "sds-cncf-kubernetes-git" gives "cncf/kubernetes"
+func (p *esSlugProvider) slugs(f *foundation) (slugs []string, err error) {
+	dashedPrefix := strings.Replace(f.Prefix, "/", "-", -1)
+	set := make(stringSet)
+	for _, source := range p.cfg.sources {
+		pattern := strings.Split(p.cfg.template, ",")[0]
+		reStr := "^" + regexp.QuoteMeta(pattern) + "$"
+		reStr = strings.Replace(reStr, regexp.QuoteMeta("{slug}"), "("+regexp.QuoteMeta(dashedPrefix)+".+?)", -1)
+		reStr = strings.Replace(reStr, regexp.QuoteMeta("{source}"), regexp.QuoteMeta(source.name), -1)
+		reStr = strings.Replace(reStr, regexp.QuoteMeta("*"), ".*", -1)
+		var re *regexp.Regexp
+		re, err = regexp.Compile(reStr)
+		if err != nil {
+			return
+		}
+		indexPattern := strings.Replace(p.cfg.template, "{slug}", dashedPrefix+"*", -1)
+		indexPattern = strings.Replace(indexPattern, "{source}", source.name, -1)
+		var body []byte
+		body, err = p.es.request("GET", "/_cat/indices/"+indexPattern+"?format=json&h=index&expand_wildcards=open", "")
+		if err != nil {
+			return
+		}
+		var indices []struct {
+			Index string `json:"index"`
+		}
+		err = json.Unmarshal(body, &indices)
+		if err != nil {
+			return
+		}
+		for _, index := range indices {
+			match := re.FindStringSubmatch(index.Index)
+			if len(match) < 2 {
+				continue
+			}
+			set[f.Prefix+strings.TrimPrefix(match[1], dashedPrefix)] = struct{}{}
+		}
+	}
+	for slug := range set {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+	return
+}
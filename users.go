@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// userStream - devstats github_users.json source, users are decoded one by one instead of reading the whole file
+// Plain, gzip and xz compressed JSON is supported (detected by content)
+type userStream struct {
+	source string
+	open   func() (io.ReadCloser, error)
+}
+
+// getUserStream - local SH_LOCAL_JSON_PATH file (defaults to github_users.json) falling back to
+// SH_REMOTE_JSON_PATH URL (defaults to https://github.com/cncf/devstats/raw/master/github_users.json)
+// Remote file is downloaded (and cached when FETCH_CACHE_DIR is set) before streaming
+// SH_JSON_SHA256 - optional expected SHA-256 sum of the (possibly compressed) file
+func getUserStream() *userStream {
+	sha := os.Getenv("SH_JSON_SHA256")
+	jsonLocalPath := os.Getenv("SH_LOCAL_JSON_PATH")
+	if jsonLocalPath == "" {
+		jsonLocalPath = "github_users.json"
+	}
+	_, err := os.Stat(jsonLocalPath)
+	if err == nil {
+		return &userStream{
+			source: jsonLocalPath,
+			open: func() (io.ReadCloser, error) {
+				checkFileSHA256(jsonLocalPath, jsonLocalPath, sha)
+				return os.Open(jsonLocalPath)
+			},
+		}
+	}
+	if !os.IsNotExist(err) {
+		fatalOnError(err)
+	}
+	jsonRemotePath := os.Getenv("SH_REMOTE_JSON_PATH")
+	if jsonRemotePath == "" {
+		jsonRemotePath = "https://github.com/cncf/devstats/raw/master/github_users.json"
+	}
+	fetcher := getSourceFetcher()
+	return &userStream{
+		source: jsonRemotePath,
+		open: func() (io.ReadCloser, error) {
+			fPath, temp, err := fetcher.fetch(jsonRemotePath)
+			if err != nil {
+				return nil, err
+			}
+			if temp {
+				defer func() { _ = os.Remove(fPath) }()
+			}
+			checkFileSHA256(jsonRemotePath, fPath, sha)
+			// Temporary file can be removed on Linux while still opened
+			return os.Open(fPath)
+		},
+	}
+}
+
+// decompress - detects gzip and xz compressed data by magic bytes, xz is decompressed using external xz binary
+// Returned close function must be called after reading is finished
+func decompress(r io.Reader) (io.Reader, func() error, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz.Close, nil
+	case bytes.Equal(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		cmd := exec.Command("xz", "-dc")
+		cmd.Stdin = br
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot start xz to decompress data: %v", err)
+		}
+		wait := func() error {
+			// Drain output so xz can exit when reading stopped early
+			_, _ = io.Copy(ioutil.Discard, out)
+			err := cmd.Wait()
+			if err != nil {
+				return fmt.Errorf("xz: %v: %s", err, stderr.String())
+			}
+			return nil
+		}
+		return out, wait, nil
+	}
+	return br, func() error { return nil }, nil
+}
+
+// each - decodes users one by one and calls fn for each of them, returns number of users
+func (s *userStream) each(fn func(user *gitHubUser)) (n int) {
+	fmt.Printf("Streaming users JSON from %s\n", s.source)
+	rc, err := s.open()
+	fatalOnError(err)
+	defer func() { _ = rc.Close() }()
+	r, closeFn, err := decompress(rc)
+	if err != nil {
+		fatalf("%s: %v", s.source, err)
+	}
+	dec := json.NewDecoder(r)
+	token, err := dec.Token()
+	if err != nil {
+		fatalf("%s: cannot parse users JSON: %v", s.source, err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		fatalf("%s: users JSON must be an array, got: %v", s.source, token)
+	}
+	for dec.More() {
+		var user gitHubUser
+		err = dec.Decode(&user)
+		if err != nil {
+			fatalf("%s: cannot parse user #%d: %v", s.source, n+1, err)
+		}
+		n++
+		fn(&user)
+	}
+	_, err = dec.Token()
+	if err != nil {
+		fatalf("%s: cannot parse users JSON end: %v", s.source, err)
+	}
+	err = closeFn()
+	if err != nil {
+		fatalf("%s: %v", s.source, err)
+	}
+	fmt.Printf("Read %d users from %s\n", n, s.source)
+	return
+}